@@ -1,80 +1,393 @@
 package tracker
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const layoutISO = "2006-01-02 15:04:05"
 
+var (
+	errBookNotFound = errors.New("book not found")
+	errNoteNotFound = errors.New("note not found")
+	errInvalidPage  = errors.New("page must be a number")
+)
+
 func ListBook(c *gin.Context) {
-	id := c.Query("id")
-	title := c.Query("title")
-	author := c.Query("author")
-	startTime := c.Query("startTime")
-	endTime := c.Query("endTime")
-	filter := map[string]string{
-		"id":        id,
-		"title":     title,
-		"author":    author,
-		"startTime": startTime,
-		"endTime":   endTime,
+	// values sent by the client only ever reach the filter through buildFilter
+	filter, err := buildFilter(bookFilters, c.Request.URL.Query())
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	// drafts stay out of the list unless includeDrafts=true
+	if c.Query("includeDrafts") != "true" {
+		filter = append(filter, bson.E{Key: "isdraft", Value: bson.M{"$ne": true}})
+	}
+
+	// rating=none finds unrated books, minRating/maxRating bound the rating
+	if rating := c.Query("rating"); rating == "none" {
+		if c.Query("minRating") != "" || c.Query("maxRating") != "" {
+			ResponseBadRequest(c, errors.New("rating=none can't be combined with minRating or maxRating"))
+			return
+		}
+		// matches a missing rating as well as a null one
+		filter = append(filter, bson.E{Key: "rating", Value: nil})
+	} else if rating != "" {
+		ResponseBadRequest(c, errors.New("rating only accepts none, use minRating and maxRating"))
+		return
+	}
+
+	finishedRange := c.Query("finishedAfter") != "" || c.Query("finishedBefore") != ""
+	// finishedYear=2023 is the shorthand for that calendar year, in tz
+	if v := c.Query("finishedYear"); v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil || year <= 0 {
+			ResponseBadRequest(c, errors.New("finishedYear must be a year such as 2023"))
+			return
+		}
+		if finishedRange {
+			ResponseBadRequest(c, errors.New("finishedYear can't be combined with finishedAfter or finishedBefore"))
+			return
+		}
+		loc, err := parseTZ(c)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+		filter = append(filter, bson.E{Key: "endtime", Value: bson.M{"$gte": start, "$lt": start.AddDate(1, 0, 0)}})
+		finishedRange = true
+	}
+	// abandoned books weren't finished, unless asked for by status
+	if finishedRange && c.Query("status") == "" {
+		filter = append(filter, bson.E{Key: "status", Value: bson.M{"$ne": StatusAbandoned}})
+	}
+
+	// hasNotes=true|false splits annotated books from untouched ones
+	if hasNotes := c.Query("hasNotes"); hasNotes != "" {
+		want, err := strconv.ParseBool(hasNotes)
+		if err != nil {
+			ResponseBadRequest(c, errors.New("hasNotes must be true or false"))
+			return
+		}
+		op := "$eq"
+		if want {
+			op = "$gt"
+		}
+		noteCount := bson.M{"$size": bson.M{"$ifNull": bson.A{"$notes", bson.A{}}}}
+		filter = append(filter, bson.E{Key: "$expr", Value: bson.M{op: bson.A{noteCount, 0}}})
+	}
+
+	// tags=scifi,classic finds books with any of the tags, or all of them
+	// with tagMode=all
+	tagMode := c.DefaultQuery("tagMode", "any")
+	if tagMode != "any" && tagMode != "all" {
+		ResponseBadRequest(c, errors.New("tagMode must be any or all"))
+		return
+	}
+	if raw, ok := c.GetQuery("tags"); ok {
+		tags := normalizeTags(strings.Split(raw, ","))
+		if len(tags) == 0 {
+			ResponseBadRequest(c, errors.New("tags must list at least one tag"))
+			return
+		}
+		op := "$in"
+		if tagMode == "all" {
+			op = "$all"
+		}
+		filter = append(filter, bson.E{Key: "tags", Value: bson.M{op: tags}})
+	} else if c.Query("tagMode") != "" {
+		ResponseBadRequest(c, errors.New("tagMode needs tags"))
+		return
 	}
-	books, err := listBook(filter)
+
+	// lent=true lists the books currently lent, lent=false the ones on the shelf
+	if lent := c.Query("lent"); lent != "" {
+		want, err := strconv.ParseBool(lent)
+		if err != nil {
+			ResponseBadRequest(c, errors.New("lent must be true or false"))
+			return
+		}
+		if want {
+			filter = append(filter, bson.E{Key: "lentto", Value: bson.M{"$gt": ""}})
+		} else {
+			filter = append(filter, bson.E{Key: "lentto", Value: notLent})
+		}
+	}
+
+	filter = andFilter(filter...)
+
+	// fields=title,author only loads and returns those fields, plus the id
+	var fields []string
+	opts := options.Find()
+	if f := c.Query("fields"); f != "" {
+		fields = append(strings.Split(f, ","), "id")
+		projection := bson.M{}
+		for _, field := range fields {
+			key, ok := bookFields[field]
+			if !ok {
+				ResponseBadRequest(c, fmt.Errorf("unknown field %q", field))
+				return
+			}
+			projection[key] = 1
+		}
+		opts.SetProjection(projection)
+	}
+
+	total, err := countBook(filter)
 	if err != nil {
 		ResponseBadRequest(c, err)
-	} else {
-		ResponseSuccess(c, books)
+		return
+	}
+
+	// page and pageSize are optional, without them the first page of
+	// defaultPageSize books is returned
+	skip, limit, err := parsePage(c)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	page, pageSize := skip/limit+1, limit
+	opts.SetSort(bson.M{"id": 1}).SetSkip(skip).SetLimit(limit)
+	// sortBy=lastActivity puts the books with the latest note activity first
+	switch c.Query("sortBy") {
+	case "":
+	case "lastActivity":
+		opts.SetSort(bson.D{{Key: "lastactivityat", Value: -1}, {Key: "id", Value: 1}})
+	default:
+		ResponseBadRequest(c, fmt.Errorf("unknown sortBy %q", c.Query("sortBy")))
+		return
+	}
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.Header("X-Page", strconv.FormatInt(page, 10))
+	c.Header("X-Page-Size", strconv.FormatInt(pageSize, 10))
+
+	books, err := listBook(filter, opts)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if fields != nil {
+		ResponseList(c, pickFields(books, fields), total)
+		return
+	}
+	ResponseList(c, books, total)
+}
+
+// Fields of a book sent for Prefer: return=minimal
+var minimalBookFields = []string{"id", "title", "status"}
+
+// preferMinimal tells whether the Prefer header asks for return=minimal.
+func preferMinimal(c *gin.Context) bool {
+	for _, header := range c.Request.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respondBook answers a write with the book as it now stands, so clients can
+// update their copy without fetching it. Prefer: return=minimal answers minimal
+// instead, e.g. the id or the count the write used to answer, without reading
+// the book back. Warnings are about the book as a whole, not only the fields
+// written.
+func respondBook(c *gin.Context, id primitive.ObjectID, minimal interface{}) {
+	c.Header("Vary", "Prefer")
+	if preferMinimal(c) {
+		c.Header("Preference-Applied", "return=minimal")
+		ResponseSuccess(c, minimal)
+		return
+	}
+	book, err := getBook(id)
+	if err != nil || book.ID.IsZero() {
+		// the write went through, only reading it back failed
+		ResponseSuccess(c, minimal)
+		return
+	}
+	ResponseWarning(c, book, book.warnings())
+}
+
+// respondNote is respondBook for notes.
+func respondNote(c *gin.Context, id primitive.ObjectID, minimal interface{}, warnings []string) {
+	c.Header("Vary", "Prefer")
+	if preferMinimal(c) {
+		c.Header("Preference-Applied", "return=minimal")
+		ResponseWarning(c, minimal, warnings)
+		return
+	}
+	note, err := getNote(id)
+	if err != nil || note.ID.IsZero() {
+		ResponseWarning(c, minimal, warnings)
+		return
 	}
+	ResponseWarning(c, note, warnings)
 }
 
+// Reading speed behind estimatedHours, pagesPerHour overrides it per request
+var defaultPagesPerHour = envInt("TRACKER_PAGES_PER_HOUR", 30)
+
 func GetBook(c *gin.Context) {
 	id := c.Param("bookid")
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		log.Println("Invalid id")
-		ResponseFailure(c, err, 504)
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	pagesPerHour := float64(defaultPagesPerHour)
+	if v := c.Query("pagesPerHour"); v != "" {
+		pagesPerHour, err = strconv.ParseFloat(v, 64)
+		if err != nil || pagesPerHour <= 0 {
+			ResponseBadRequest(c, errors.New("pagesPerHour must be a positive number"))
+			return
+		}
 	}
 	book, err := getBook(oid)
 	if err != nil {
 		ResponseBadRequest(c, err)
+		return
+	}
+	book.setEstimatedHours(pagesPerHour)
+
+	// Prefer: return=minimal only sends the core fields, return=representation
+	// (the default) the whole book. Other preferences are ignored.
+	c.Header("Vary", "Prefer")
+	if preferMinimal(c) {
+		c.Header("Preference-Applied", "return=minimal")
+		ResponseSuccess(c, pickFields([]Book{book}, minimalBookFields)[0])
+		return
+	}
+
+	// the estimated hours depend on the reading speed asked for
+	var data interface{} = book
+	variant := strconv.FormatFloat(pagesPerHour, 'g', -1, 64)
+	// withNotes=true expands the note ids into the notes themselves, which are
+	// edited without touching the book
+	if c.Query("withNotes") == "true" {
+		notes, err := listNoteByID(book.Notes)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		content, err := json.Marshal(notes)
+		if err != nil {
+			ResponseError(c, err)
+			return
+		}
+		data = bookWithNotes{Book: book, Notes: notes}
+		variant += string(content)
+	}
+
+	etag := bookETag(book, variant)
+	c.Header("ETag", etag)
+	if etagMatch(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	ResponseSuccess(c, data)
+}
+
+// GetBookBySlug gets a book by its slug rather than its id.
+func GetBookBySlug(c *gin.Context) {
+	book, err := getBookBySlug(c.Param("slug"))
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
 	} else {
 		ResponseSuccess(c, book)
 	}
 }
 
+// AddBook creates a book, answering every invalid field at once.
 func AddBook(c *gin.Context) {
-	title := c.PostForm("title")
-	author := c.PostForm("author")
-	status, _ := strconv.Atoi(c.PostForm("status"))
-	startTime, _ := time.Parse(layoutISO, c.PostForm("startTime"))
-	endTime, _ := time.Parse(layoutISO, c.PostForm("endTime"))
-	description := c.PostForm("description")
+	var v validator
+	title := normalizeSpace(c.PostForm("title"))
+	v.require("title", title)
+	status := StatusToRead
+	if s := c.PostForm("status"); s != "" {
+		var err error
+		status, err = parseStatus(s)
+		v.check("status", err)
+	}
+	startTime, _, err := formTime(c, "startTime")
+	startOK := v.check("startTime", err)
+	endTime, _, err := formTime(c, "endTime")
+	endOK := v.check("endTime", err)
+	if startOK && endOK {
+		v.check("endTime", checkReadingTimes(startTime, endTime))
+	}
+	description := strings.TrimSpace(c.PostForm("description"))
+	series := normalizeSpace(c.PostForm("series"))
+	seriesOrder, err := optionalInt(c.PostForm("seriesOrder"))
+	if err != nil {
+		v.check("seriesOrder", errors.New("seriesOrder must be a number"))
+	}
+	rating, err := parseRating(c.PostForm("rating"))
+	v.check("rating", err)
+	totalPages, err := parseTotalPages(c.PostForm("totalPages"))
+	v.check("totalPages", err)
+	if !v.valid() {
+		ResponseInvalid(c, &v)
+		return
+	}
+	isDraft := c.PostForm("isDraft") == "true"
 	book := Book{
 		Title:       title,
-		Author:      author,
 		Status:      status,
 		StartTime:   startTime,
 		EndTime:     endTime,
 		Description: description,
+		Series:      series,
+		SeriesOrder: seriesOrder,
+		TotalPages:  totalPages,
+		Tags:        normalizeTags(c.PostFormArray("tags")),
+		ISBN:        normalizeISBN(c.PostForm("isbn")),
+		Rating:      rating,
+		IsDraft:     isDraft,
+	}
+	book.setAuthors(formAuthors(c))
+	oid, err := idempotent(c, "book", func() (primitive.ObjectID, error) {
+		return addBook(&book)
+	})
+	if err == errIdempotencyInProgress {
+		ResponseFailure(c, err, http.StatusConflict)
+		return
 	}
-	oid, err := addBook(&book)
 	if err != nil {
-		ResponseBadRequest(c, err)
+		ResponseWriteError(c, err)
+		return
 	}
-	ResponseSuccess(c, oid)
+	respondBook(c, oid, oid)
 }
 
 func DeleteBook(c *gin.Context) {
 	id := c.PostForm("id")
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		log.Println("Invalid id")
-		ResponseFailure(c, err, 504)
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
 	}
 	deleteCount, err := deleteBook(oid)
 	if err != nil {
@@ -85,104 +398,1639 @@ func DeleteBook(c *gin.Context) {
 }
 
 func EditBook(c *gin.Context) {
+	// the path is the only source of the id, an id sent in the body is ignored
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	// the stored book tells whether this edit finishes it
+	previous, err := getBook(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if previous.ID.IsZero() {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	}
+
 	fields := make(map[string]interface{})
-	fields["id"], _ = primitive.ObjectIDFromHex(c.Param("bookid"))
-	fields["title"] = c.PostForm("title")
-	fields["author"] = c.PostForm("author")
-	fields["status"], _ = strconv.Atoi(c.PostForm("status"))
-	fields["startTime"], _ = time.Parse(layoutISO, c.PostForm("startTime"))
-	fields["endTime"], _ = time.Parse(layoutISO, c.PostForm("endTime"))
-	fields["description"] = c.PostForm("description")
+	fields["title"] = normalizeSpace(c.PostForm("title"))
+	if authors := formAuthors(c); len(authors) > 0 {
+		var book Book
+		book.setAuthors(authors)
+		fields["author"] = book.Author
+		fields["authors"] = book.Authors
+	}
+	// status is only changed when sent, and along an allowed transition
+	if status := c.PostForm("status"); status != "" {
+		if fields["status"], err = parseStatus(status); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		if err := checkTransition(previous.Status, fields["status"].(int)); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+	startTime, startSet, err := formTime(c, "startTime")
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	endTime, endSet, err := formTime(c, "endTime")
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if startSet || endSet {
+		// the time not sent keeps its stored value, check against that
+		if !startSet {
+			startTime = previous.StartTime
+		}
+		if !endSet {
+			endTime = previous.EndTime
+		}
+		if err := checkReadingTimes(startTime, endTime); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+	if startSet {
+		fields["starttime"] = startTime
+	}
+	if endSet {
+		fields["endtime"] = endTime
+	}
+	fields["description"] = strings.TrimSpace(c.PostForm("description"))
+	fields["series"] = normalizeSpace(c.PostForm("series"))
+	if seriesOrder := c.PostForm("seriesOrder"); seriesOrder != "" {
+		if fields["seriesorder"], err = optionalInt(seriesOrder); err != nil {
+			ResponseBadRequest(c, errors.New("seriesOrder must be a number"))
+			return
+		}
+	}
+	// tags replace the book's tags when sent, a single empty one clears them
+	if tags, ok := c.GetPostFormArray("tags"); ok {
+		fields["tags"] = normalizeTags(tags)
+	}
+	if totalPages := c.PostForm("totalPages"); totalPages != "" {
+		if fields["totalpages"], err = parseTotalPages(totalPages); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+	fields["isbn"] = normalizeISBN(c.PostForm("isbn"))
+	// a new title gets a new slug, the old one stops resolving
+	if title := fields["title"].(string); title != "" && title != previous.Title {
+		if fields["slug"], err = bookSlug(oid, title); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+	// rating=none clears the rating
+	if rating := c.PostForm("rating"); rating == "none" {
+		fields["rating"] = nil
+	} else if rating != "" {
+		if fields["rating"], err = parseRating(rating); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+
+	editCount, err := editBook(oid, fields)
+	if err != nil {
+		ResponseWriteError(c, err)
+		return
+	}
+	// only an edit setting the status can finish the book
+	if status, ok := fields["status"]; ok && status == StatusFinished && previous.Status != StatusFinished {
+		if book, err := getBook(oid); err == nil && book.Status == StatusFinished {
+			notifyFinished(book)
+		}
+	}
+	respondBook(c, oid, editCount)
+}
+
+// ReplaceBook overwrites every field of the book with the form, clearing the
+// optional fields left out. The id, creation time and notes are kept.
+func ReplaceBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	previous, err := getBook(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if previous.ID.IsZero() {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	}
+
+	title := normalizeSpace(c.PostForm("title"))
+	if title == "" {
+		ResponseBadRequest(c, errors.New("title is required"))
+		return
+	}
+	if c.PostForm("status") == "" {
+		ResponseBadRequest(c, errors.New("status is required"))
+		return
+	}
+	status, err := parseStatus(c.PostForm("status"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkTransition(previous.Status, status); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	startTime, _, err := formTime(c, "startTime")
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	endTime, _, err := formTime(c, "endTime")
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkReadingTimes(startTime, endTime); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	seriesOrder, err := optionalInt(c.PostForm("seriesOrder"))
+	if err != nil {
+		ResponseBadRequest(c, errors.New("seriesOrder must be a number"))
+		return
+	}
+	totalPages, err := parseTotalPages(c.PostForm("totalPages"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	rating, err := parseRating(c.PostForm("rating"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	book := Book{
+		ID:          oid,
+		Title:       title,
+		Status:      status,
+		StartTime:   startTime,
+		EndTime:     endTime,
+		Notes:       previous.Notes,
+		Description: strings.TrimSpace(c.PostForm("description")),
+		Series:      normalizeSpace(c.PostForm("series")),
+		SeriesOrder: seriesOrder,
+		TotalPages:  totalPages,
+		Tags:        normalizeTags(c.PostFormArray("tags")),
+		ISBN:        normalizeISBN(c.PostForm("isbn")),
+		Rating:      rating,
+		Slug:        previous.Slug,
+		IsDraft:     previous.IsDraft,
+		CreatedAt:   previous.CreatedAt,
+		// note activity isn't part of the book's data
+		LastActivityAt: previous.LastActivityAt,
+		// nor is lending, see LendBook
+		LentTo: previous.LentTo,
+		LentAt: previous.LentAt,
+		// the cover is uploaded on its own
+		CoverID: previous.CoverID,
+	}
+	book.setAuthors(formAuthors(c))
+	if title != previous.Title {
+		if book.Slug, err = bookSlug(oid, title); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+
+	err = replaceBook(&book)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	} else if err != nil {
+		ResponseWriteError(c, err)
+		return
+	}
+	if previous.Status != StatusFinished && book.Status == StatusFinished {
+		notifyFinished(book)
+	}
+	book.afterRead()
+	ResponseWarning(c, book, book.warnings())
+}
+
+// MergeBook folds the duplicate book mergeId into keepId, moving its notes,
+// and answers how many notes moved.
+func MergeBook(c *gin.Context) {
+	keepID, err := primitive.ObjectIDFromHex(c.PostForm("keepId"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, fmt.Errorf("keepId: %v", err))
+		return
+	}
+	mergeID, err := primitive.ObjectIDFromHex(c.PostForm("mergeId"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, fmt.Errorf("mergeId: %v", err))
+		return
+	}
+	if keepID == mergeID {
+		ResponseBadRequest(c, errors.New("a book can't be merged into itself"))
+		return
+	}
+	moved, err := mergeBook(keepID, mergeID)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseTransactionError(c, err)
+	} else {
+		ResponseSuccess(c, moved)
+	}
+}
+
+// RereadBook starts a new entry for reading the book again: same title,
+// authors and description, but to read, without dates or notes. The
+// original keeps its notes.
+func RereadBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	original, err := getBook(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if original.ID.IsZero() {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	}
+
+	// the ISBN stays with the original, it's unique
+	book := Book{
+		Title:       original.Title,
+		Status:      StatusToRead,
+		Notes:       []primitive.ObjectID{},
+		Description: original.Description,
+		Series:      original.Series,
+		SeriesOrder: original.SeriesOrder,
+		RereadOf:    &original.ID,
+	}
+	book.setAuthors(original.Authors)
+	id, err := idempotent(c, "reread", func() (primitive.ObjectID, error) {
+		return addBook(&book)
+	})
+	if err == errIdempotencyInProgress {
+		ResponseFailure(c, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		ResponseWriteError(c, err)
+		return
+	}
+	// a retried request gets the entry created the first time
+	created, err := getBook(id)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	ResponseSuccess(c, created)
+}
 
-	editCount, err := editBook(fields)
+// PublishBook turns a draft into a regular book, shown in the main list.
+func PublishBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
 	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	editCount, err := publishBook(oid)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
 		ResponseBadRequest(c, err)
 	} else {
-		ResponseSuccess(c, editCount)
+		respondBook(c, oid, editCount)
 	}
 }
 
-// Note
-func ListNoteByBook(c *gin.Context) {
-	id := c.Query("bookid")
-	oid, err := primitive.ObjectIDFromHex(id)
+// UploadCover stores the image sent as the multipart file cover as the
+// book's cover, answering the URL it is served at. Only images of at most
+// maxCoverBytes are accepted, their type is sniffed rather than trusted.
+func UploadCover(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	header, err := c.FormFile("cover")
 	if err != nil {
-		log.Println("Invalid id")
-		ResponseFailure(c, err, 504)
+		ResponseBadRequest(c, errors.New("cover is required"))
+		return
 	}
-	notes, err := listNoteByBook(oid)
+	if header.Size > int64(maxCoverBytes) {
+		ResponseFailure(c, fmt.Errorf("cover can't be larger than %d bytes", maxCoverBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if ct := header.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") {
+		ResponseFailure(c, errors.New("cover must be an image"), http.StatusUnsupportedMediaType)
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	defer file.Close()
+	image, err := ioutil.ReadAll(io.LimitReader(file, int64(maxCoverBytes)+1))
 	if err != nil {
 		ResponseBadRequest(c, err)
+		return
+	}
+	if len(image) > maxCoverBytes {
+		ResponseFailure(c, fmt.Errorf("cover can't be larger than %d bytes", maxCoverBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	contentType := http.DetectContentType(image)
+	if !strings.HasPrefix(contentType, "image/") {
+		ResponseFailure(c, errors.New("cover must be an image"), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err = setCover(oid, image, contentType)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
 	} else {
-		ResponseSuccess(c, notes)
+		ResponseSuccess(c, coverURL(oid))
 	}
 }
 
-func GetNote(c *gin.Context) {
-	id := c.Param("noteid")
-	oid, err := primitive.ObjectIDFromHex(id)
+// GetCover serves the uploaded cover of the book.
+func GetCover(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
 	if err != nil {
-		log.Println("Invalid id")
-		ResponseFailure(c, err, 504)
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
 	}
-	note, err := getNote(oid)
+	stream, contentType, err := openCover(oid)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	} else if err == errNoCover {
+		ResponseFailure(c, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	defer stream.Close()
+	// every upload is a new file, its id tells whether the cover changed
+	file := stream.GetFile()
+	if fileID, ok := file.ID.(primitive.ObjectID); ok {
+		etag := `"` + fileID.Hex() + `"`
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", "no-cache")
+		if etagMatch(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, file.Length, contentType, stream, nil)
+}
+
+// LendBook records who borrowed the book, from the form value to. A book
+// that is already lent must be returned first.
+func LendBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
 	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	to := strings.TrimSpace(c.PostForm("to"))
+	if to == "" {
+		ResponseBadRequest(c, errors.New("to is required"))
+		return
+	}
+	editCount, err := lendBook(oid, to, time.Now())
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err == errAlreadyLent {
+		ResponseFailure(c, err, http.StatusConflict)
+	} else if err != nil {
 		ResponseBadRequest(c, err)
 	} else {
-		ResponseSuccess(c, note)
+		respondBook(c, oid, editCount)
 	}
 }
 
-func AddNote(c *gin.Context) {
-	id := c.PostForm("bookID")
-	content := c.PostForm("content")
+// ReturnBook puts a lent book back on the shelf.
+func ReturnBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	editCount, err := returnBook(oid)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err == errNotLent {
+		ResponseFailure(c, err, http.StatusConflict)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		respondBook(c, oid, editCount)
+	}
+}
 
-	bookID, err := primitive.ObjectIDFromHex(id)
+func ListSeries(c *gin.Context) {
+	series, err := listSeries()
 	if err != nil {
-		log.Println("Invalid id")
-		ResponseFailure(c, err, 504)
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, series)
 	}
-	note := Note{
-		BookID:  bookID,
-		Content: content,
+}
+
+// ListIncompleteBook is the cleanup worklist: the books missing an author, a
+// description, or the dates and rating of a finished book.
+func ListIncompleteBook(c *gin.Context) {
+	books, err := listIncompleteBook()
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, books)
 	}
+}
 
-	oid, err := addNote(bookID, &note)
+func ListSeriesBook(c *gin.Context) {
+	books, err := listSeriesBook(c.Param("name"))
 	if err != nil {
 		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, books)
 	}
-	ResponseSuccess(c, oid)
 }
 
-func DeleteNote(c *gin.Context) {
-	id := c.PostForm("id")
-	oid, err := primitive.ObjectIDFromHex(id)
+// formTime parses an optional layoutISO form value, set tells if it was sent.
+func formTime(c *gin.Context, key string) (t time.Time, set bool, err error) {
+	v := c.PostForm(key)
+	if v == "" {
+		return t, false, nil
+	}
+	t, err = time.Parse(layoutISO, v)
 	if err != nil {
-		log.Println("Invalid id")
-		ResponseFailure(c, err, 504)
+		return t, false, fmt.Errorf("%s must look like %q", key, layoutISO)
 	}
-	deleteCount, err := deleteNote(oid)
+	return t, true, nil
+}
+
+// formAuthors reads the repeated authors form value, falling back to the
+// single author one.
+func formAuthors(c *gin.Context) []string {
+	values := c.PostFormArray("authors")
+	if len(values) == 0 {
+		values = []string{c.PostForm("author")}
+	}
+	var authors []string
+	for _, author := range values {
+		if author = normalizeSpace(author); author != "" {
+			authors = append(authors, author)
+		}
+	}
+	return authors
+}
+
+// BatchGetBook fetches several books at once, ids are repeated form values.
+func BatchGetBook(c *gin.Context) {
+	ids, err := parseObjectIDs(c.PostFormArray("ids"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkBatchSize("ids", len(ids)); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	batch, err := listBookByID(ids)
 	if err != nil {
 		ResponseBadRequest(c, err)
 	} else {
-		ResponseSuccess(c, deleteCount)
+		ResponseSuccess(c, batch)
+	}
+}
+
+// EditBookStatus sets one status on several books, ids are repeated form
+// values. The books that can't go to the status are reported and left alone.
+func EditBookStatus(c *gin.Context) {
+	ids, err := parseObjectIDs(c.PostFormArray("ids"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkBatchSize("ids", len(ids)); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	status, err := parseStatus(c.PostForm("status"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	batch, err := editBookStatus(ids, status)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if status == StatusFinished {
+		for _, id := range batch.moved {
+			if book, err := getBook(id); err == nil && book.Status == StatusFinished {
+				notifyFinished(book)
+			}
+		}
 	}
+	ResponseSuccess(c, batch)
 }
 
-// func EditNote(c *gin.Context) {
-// 	fields := make(map[string]interface{})
-// 	fields["id"], _ = primitive.ObjectIDFromHex(c.Param("bookid"))
-// 	fields["title"] = c.PostForm("title")
-// 	fields["author"] = c.PostForm("author")
-// 	fields["status"], _ = strconv.Atoi(c.PostForm("status"))
-// 	fields["startTime"], _ = time.Parse(layoutISO, c.PostForm("startTime"))
-// 	fields["endTime"], _ = time.Parse(layoutISO, c.PostForm("endTime"))
-// 	fields["description"] = c.PostForm("description")
-
-// 	editCount, err := editNote(fields)
-// 	if err != nil {
-// 		ResponseBadRequest(c, err)
-// 	} else {
-// 		ResponseSuccess(c, editCount)
-// 	}
-// }
+// EditBookTags adds the addTags to and removes the removeTags from every book
+// of ids, all repeated form values. It returns how many books changed.
+func EditBookTags(c *gin.Context) {
+	ids, err := parseObjectIDs(c.PostFormArray("ids"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkBatchSize("ids", len(ids)); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	add := normalizeTags(c.PostFormArray("addTags"))
+	remove := normalizeTags(c.PostFormArray("removeTags"))
+	if len(add) == 0 && len(remove) == 0 {
+		ResponseBadRequest(c, errors.New("addTags or removeTags is required"))
+		return
+	}
+	for _, tag := range add {
+		for _, other := range remove {
+			if tag == other {
+				ResponseBadRequest(c, fmt.Errorf("tag %q can't be both added and removed", tag))
+				return
+			}
+		}
+	}
+	editCount, err := editBookTags(ids, add, remove)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, editCount)
+	}
+}
+
+// DistinctBookField lists the values of a filterable field with their counts.
+func DistinctBookField(c *gin.Context) {
+	field := c.Param("field")
+	if _, ok := distinctFields[field]; !ok {
+		ResponseBadRequest(c, fmt.Errorf("field %q can't be listed", field))
+		return
+	}
+	counts, err := distinctBookField(field)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, counts)
+	}
+}
+
+// Return at most N author suggestions
+const authorSuggestionLimit = 10
+
+// ListAuthor suggests existing authors for an autocomplete box.
+func ListAuthor(c *gin.Context) {
+	authors, err := listAuthor(strings.TrimSpace(c.Query("prefix")), authorSuggestionLimit)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, authors)
+	}
+}
+
+const (
+	defaultRecentLimit = 10
+	maxRecentLimit     = 50
+	defaultTopAuthors  = 10
+	maxTopAuthors      = 50
+	defaultNoteStats   = 10
+	maxNoteStats       = 100
+)
+
+// GetTopAuthors ranks the most read authors, limit defaults to 10, at most 50.
+func GetTopAuthors(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultTopAuthors)))
+	if err != nil || limit < 1 {
+		ResponseBadRequest(c, errors.New("limit must be a positive number"))
+		return
+	}
+	if limit > maxTopAuthors {
+		limit = maxTopAuthors
+	}
+	counts, err := topAuthors(int64(limit))
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, counts)
+	}
+}
+
+// ListRecentBook lists the latest additions, limit defaults to 10, at most 50.
+func ListRecentBook(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRecentLimit)))
+	if err != nil || limit < 1 {
+		ResponseBadRequest(c, errors.New("limit must be a positive number"))
+		return
+	}
+	if limit > maxRecentLimit {
+		limit = maxRecentLimit
+	}
+	books, err := listRecentBook(int64(limit))
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, books)
+	}
+}
+
+// RandomBook suggests a random book, optionally limited to some statuses.
+func RandomBook(c *gin.Context) {
+	var filter bson.D
+	if status := c.Query("status"); status != "" {
+		statuses, err := parseStatusList(status)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		filter = append(filter, bson.E{Key: "status", Value: bson.M{"$in": statuses}})
+	}
+	book, err := randomBook(filter)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, book)
+	}
+}
+
+func GetDurationStats(c *gin.Context) {
+	stats, err := durationStats()
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, stats)
+	}
+}
+
+// GetStreak reports the current and longest reading streaks, in days unless
+// unit=week. Days are counted in the tz zone, UTC by default.
+func GetStreak(c *gin.Context) {
+	unit := c.DefaultQuery("unit", "day")
+	if unit != "day" && unit != "week" {
+		ResponseBadRequest(c, errors.New("unit must be day or week"))
+		return
+	}
+	loc, err := parseTZ(c)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	days, err := activeDays(loc)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, computeStreak(days, unit == "week", time.Now().In(loc)))
+	}
+}
+
+// ExportBook downloads the book and its notes as a Markdown document.
+func ExportBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	book, err := getBook(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if book.ID.IsZero() {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	}
+	notes, err := listNoteByID(book.Notes)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(book)))
+	c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(bookMarkdown(book, notes)))
+}
+
+// NextInSeries suggests, once a book is finished, the next book of its series
+// that isn't finished yet.
+func NextInSeries(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	book, err := getBook(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if book.ID.IsZero() {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+		return
+	}
+	next, err := nextInSeries(book)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errors.New("no next book in series"), http.StatusNotFound)
+	} else if err == errNotFinished {
+		ResponseFailure(c, err, http.StatusConflict)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, next)
+	}
+}
+
+// Note
+func ListNoteByBook(c *gin.Context) {
+	id := strings.TrimSpace(c.Query("bookid"))
+	if id == "" {
+		ResponseBadRequest(c, errors.New("bookid is required"))
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	notes, err := listNoteByBook(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	// type=quote only keeps the notes of that type
+	if noteType := c.Query("type"); noteType != "" {
+		if noteType, err = parseNoteType(noteType); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		matched := []Note{}
+		for _, note := range notes {
+			if note.Type == noteType {
+				matched = append(matched, note)
+			}
+		}
+		notes = matched
+	}
+
+	// unreadOnly=true leaves out the notes already reviewed
+	if c.Query("unreadOnly") == "true" {
+		unread := []Note{}
+		for _, note := range notes {
+			if !note.Read {
+				unread = append(unread, note)
+			}
+		}
+		notes = unread
+	}
+
+	// color=yellow only keeps the notes highlighted in that color
+	if color := c.Query("color"); color != "" {
+		if color, err = parseColor(color); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		matched := []Note{}
+		for _, note := range notes {
+			if note.Color == color {
+				matched = append(matched, note)
+			}
+		}
+		notes = matched
+	}
+
+	switch c.Query("sort") {
+	case "page":
+		// sort=page orders by page, notes without one go last
+		sort.SliceStable(notes, func(i, j int) bool {
+			if notes[i].Page == 0 || notes[j].Page == 0 {
+				return notes[j].Page == 0 && notes[i].Page != 0
+			}
+			return notes[i].Page < notes[j].Page
+		})
+	case "order":
+		// sort=order is the manual order, notes never reordered keep the order they were added in
+		sort.SliceStable(notes, func(i, j int) bool {
+			return notes[i].Order < notes[j].Order
+		})
+	case "", "createTime":
+		// oldest first unless order=desc, ties broken by id
+		desc := c.Query("order") == "desc"
+		sort.SliceStable(notes, func(i, j int) bool {
+			a, b := notes[i], notes[j]
+			if desc {
+				a, b = b, a
+			}
+			if !a.CreateTime.Equal(b.CreateTime) {
+				return a.CreateTime.Before(b.CreateTime)
+			}
+			return a.ID.Hex() < b.ID.Hex()
+		})
+	default:
+		ResponseBadRequest(c, fmt.Errorf("unknown sort %q", c.Query("sort")))
+		return
+	}
+
+	// pinnedFirst=true moves the pinned notes on top, keeping the order chosen above
+	if c.Query("pinnedFirst") == "true" {
+		sort.SliceStable(notes, func(i, j int) bool {
+			return notes[i].Pinned && !notes[j].Pinned
+		})
+	}
+
+	// page and pageSize are optional, without them every note is returned
+	total := int64(len(notes))
+	if pageWanted(c) {
+		skip, limit, err := parsePage(c)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		if skip > total {
+			skip = total
+		}
+		if end := skip + limit; end < total {
+			notes = notes[skip:end]
+		} else {
+			notes = notes[skip:]
+		}
+	}
+
+	// withBook=true adds the book title to every note
+	if c.Query("withBook") == "true" {
+		book, err := getBook(oid)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		withBook := make([]noteWithBook, len(notes))
+		for i, note := range notes {
+			withBook[i] = noteWithBook{Note: note, BookTitle: book.Title}
+		}
+		ResponseList(c, withBook, total)
+		return
+	}
+	ResponseList(c, notes, total)
+}
+
+const (
+	// Return at most N notes from a search
+	noteSearchLimit = 50
+	// Return at most N books and N notes from a global search
+	searchLimitPerType = 20
+)
+
+// Search looks for q in books and notes at once, books first. fuzzy=true
+// matches book titles despite typos, closest first.
+func Search(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		ResponseBadRequest(c, errors.New("q is required"))
+		return
+	}
+	var results []SearchResult
+	if c.Query("fuzzy") == "true" {
+		books, err := fuzzySearchBook(q, searchLimitPerType)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		for i := range books {
+			results = append(results, SearchResult{Type: "book", Book: &books[i].Book, Score: books[i].Score})
+		}
+	} else {
+		books, err := searchBook(q, searchLimitPerType)
+		if err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		for i := range books {
+			results = append(results, SearchResult{Type: "book", Book: &books[i]})
+		}
+	}
+	notes, err := searchNote(q, searchLimitPerType)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	for i := range notes {
+		results = append(results, SearchResult{Type: "note", Note: &notes[i]})
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	ResponseSuccess(c, results)
+}
+
+// SearchNote finds notes containing q, with where it matched.
+func SearchNote(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		ResponseBadRequest(c, errors.New("q is required"))
+		return
+	}
+	matches, err := searchNote(q, noteSearchLimit)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, matches)
+	}
+}
+
+// DeleteNoteByBook deletes every note of a book, keeping the book.
+func DeleteNoteByBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	deleteCount, err := deleteNoteByBook(oid)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseTransactionError(c, err)
+	} else {
+		ResponseSuccess(c, deleteCount)
+	}
+}
+
+// ReorderNote persists a manual order of the book's notes, ids listing every
+// note of the book in its new position.
+func ReorderNote(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	ids, err := parseObjectIDs(c.PostFormArray("ids"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	err = reorderNote(oid, ids)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err == errNoteChanged {
+		ResponseFailure(c, err, http.StatusConflict)
+	} else if err != nil {
+		ResponseTransactionError(c, err)
+	} else {
+		ResponseSuccess(c, ids)
+	}
+}
+
+// ListAllNote is the feed of every note, newest first unless order=asc, Total
+// counting them across every page. bookid, color and type narrow it down.
+func ListAllNote(c *gin.Context) {
+	skip, limit, err := parsePage(c)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	filter, err := buildFilter(noteFilters, c.Request.URL.Query())
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	// isReply=true keeps replies, false the notes starting a thread
+	if isReply := c.Query("isReply"); isReply != "" {
+		want, err := strconv.ParseBool(isReply)
+		if err != nil {
+			ResponseBadRequest(c, errors.New("isReply must be true or false"))
+			return
+		}
+		// notes stored before replies existed have no replyto at all
+		rootReply := bson.A{primitive.NilObjectID, nil}
+		op := "$in"
+		if want {
+			op = "$nin"
+		}
+		filter = append(filter, bson.E{Key: "replyto", Value: bson.M{op: rootReply}})
+	}
+	total, err := countNote(filter)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	notes, err := listAllNote(filter, skip, limit, c.Query("order") == "asc")
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseList(c, notes, total)
+	}
+}
+
+func GetNote(c *gin.Context) {
+	id := c.Param("noteid")
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+
+	// withBook=true adds the title of the note's book
+	var note noteWithBook
+	if c.Query("withBook") == "true" {
+		note, err = getNoteWithBook(oid)
+	} else {
+		note.Note, err = getNote(oid)
+	}
+	if err != nil {
+		ResponseError(c, err)
+		return
+	}
+	if note.ID.IsZero() {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+		return
+	}
+
+	// render=html adds the markdown content rendered server side
+	if c.Query("render") == "html" {
+		html, err := renderMarkdown(note.Content)
+		if err != nil {
+			ResponseError(c, err)
+			return
+		}
+		ResponseSuccess(c, renderedNote{noteWithBook: note, ContentHTML: html})
+		return
+	}
+	ResponseSuccess(c, note)
+}
+
+func AddNote(c *gin.Context) {
+	id := c.PostForm("bookID")
+	content := c.PostForm("content")
+
+	bookID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkNoteContent(content); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	page, err := optionalInt(c.PostForm("page"))
+	if err != nil {
+		ResponseBadRequest(c, errInvalidPage)
+		return
+	}
+	color, err := parseColor(c.PostForm("color"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	noteType, err := parseNoteType(c.PostForm("type"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	// replyTo makes the note a reply to another note of the same book
+	var replyTo primitive.ObjectID
+	if v := c.PostForm("replyTo"); v != "" {
+		if replyTo, err = primitive.ObjectIDFromHex(v); err != nil {
+			ResponseBadRequest(c, errors.New("replyTo must be a note id"))
+			return
+		}
+		parent, err := getNote(replyTo)
+		if err != nil {
+			ResponseError(c, err)
+			return
+		}
+		if parent.ID.IsZero() || parent.BookID != bookID {
+			ResponseBadRequest(c, errors.New("replyTo must be a note of the same book"))
+			return
+		}
+	}
+	note := Note{
+		BookID:      bookID,
+		Content:     content,
+		ReplyTo:     replyTo,
+		Page:        page,
+		Location:    c.PostForm("location"),
+		Color:       color,
+		Type:        noteType,
+		Attribution: normalizeSpace(c.PostForm("attribution")),
+	}
+
+	oid, err := idempotent(c, "note", func() (primitive.ObjectID, error) {
+		return addNote(bookID, &note)
+	})
+	if err == errIdempotencyInProgress {
+		ResponseFailure(c, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	respondNote(c, oid, oid, nil)
+}
+
+// Longest note content accepted, in characters
+const maxNoteLength = 10000
+
+// checkNoteContent rejects empty and overlong note contents.
+func checkNoteContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return errors.New("content is required")
+	}
+	if n := utf8.RuneCountInString(content); n > maxNoteLength {
+		return fmt.Errorf("content is %d characters long, at most %d are allowed", n, maxNoteLength)
+	}
+	return nil
+}
+
+// ImportNote adds one note per content value to the book, in the order sent,
+// e.g. highlights exported from an e-reader. Either every note is added or none.
+func ImportNote(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	contents := c.PostFormArray("content")
+	if len(contents) == 0 {
+		ResponseBadRequest(c, errors.New("content is required"))
+		return
+	}
+	if err := checkBatchSize("content", len(contents)); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	for i, content := range contents {
+		if err := checkNoteContent(content); err != nil {
+			ResponseBadRequest(c, fmt.Errorf("note %d: %v", i, err))
+			return
+		}
+	}
+	ids, err := addNotes(oid, contents)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseTransactionError(c, err)
+	} else {
+		ResponseSuccess(c, ids)
+	}
+}
+
+// parseEditSeq reads the sequence number of a note edit.
+func parseEditSeq(s string) (int64, error) {
+	seq, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seq < 1 {
+		return 0, errors.New("seq must be a positive number")
+	}
+	return seq, nil
+}
+
+// BatchEditNote flushes the contents an editor buffered, ids, contents and
+// seqs being repeated form values matched by position. Only the edit with the
+// highest seq of a note in the batch is applied, and like with EditNote it is
+// skipped when an edit with a later seq was applied already.
+//
+// Each edit is applied on its own rather than in a transaction: one failing
+// doesn't hold back the others, at the price of a batch applying in part.
+// The outcome of every note is returned.
+func BatchEditNote(c *gin.Context) {
+	ids, err := parseObjectIDs(c.PostFormArray("ids"))
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if err := checkBatchSize("ids", len(ids)); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	contents := c.PostFormArray("contents")
+	seqs := c.PostFormArray("seqs")
+	if len(ids) == 0 || len(contents) != len(ids) || len(seqs) != len(ids) {
+		ResponseBadRequest(c, errors.New("ids, contents and seqs must have one value per edit"))
+		return
+	}
+
+	// the edit with the highest seq of each note wins, the others are dropped
+	latest := map[primitive.ObjectID]int{}
+	parsed := make([]int64, len(seqs))
+	var order []primitive.ObjectID
+	for i, id := range ids {
+		if err := checkNoteContent(contents[i]); err != nil {
+			ResponseBadRequest(c, fmt.Errorf("edit %d: %v", i, err))
+			return
+		}
+		if parsed[i], err = parseEditSeq(seqs[i]); err != nil {
+			ResponseBadRequest(c, fmt.Errorf("edit %d: %v", i, err))
+			return
+		}
+		j, ok := latest[id]
+		if !ok {
+			order = append(order, id)
+		}
+		if !ok || parsed[i] >= parsed[j] {
+			latest[id] = i
+		}
+	}
+
+	edits := make([]NoteEdit, 0, len(order))
+	for _, id := range order {
+		i := latest[id]
+		editCount, err := editNote(id, map[string]interface{}{"content": contents[i], "editseq": parsed[i]})
+		edit := NoteEdit{ID: id, Edited: editCount > 0}
+		if err == mongo.ErrNoDocuments {
+			edit.Error = errNoteNotFound.Error()
+		} else if err == errStaleEdit {
+			edit.Skipped = true
+		} else if err != nil {
+			edit.Error = err.Error()
+		}
+		edits = append(edits, edit)
+	}
+	ResponseSuccess(c, edits)
+}
+
+// Undo restores the latest deleted book, note or notes of a book, see undoBuffer.
+func Undo(c *gin.Context) {
+	result, err := undoDelete()
+	if err == errNothingToUndo {
+		ResponseFailure(c, err, http.StatusNotFound)
+	} else if err != nil {
+		ResponseTransactionError(c, err)
+	} else {
+		ResponseSuccess(c, result)
+	}
+}
+
+func DeleteNote(c *gin.Context) {
+	id := c.PostForm("id")
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	deleteCount, err := deleteNote(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, deleteCount)
+	}
+}
+
+func EditNote(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	fields := make(map[string]interface{})
+	// content is only changed when sent, and held to the same cap as a new note's
+	if content := c.PostForm("content"); content != "" {
+		if err := checkNoteContent(content); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+		fields["content"] = content
+	}
+	fields["location"] = c.PostForm("location")
+	if fields["color"], err = parseColor(c.PostForm("color")); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	if fields["type"], err = parseNoteType(c.PostForm("type")); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	fields["attribution"] = normalizeSpace(c.PostForm("attribution"))
+	if page := c.PostForm("page"); page != "" {
+		if fields["page"], err = strconv.Atoi(page); err != nil {
+			ResponseBadRequest(c, errInvalidPage)
+			return
+		}
+	}
+
+	// an editor autosaving sends increasing seq values, so a slow request
+	// can't overwrite a later edit
+	if seq := c.PostForm("seq"); seq != "" {
+		if fields["editseq"], err = parseEditSeq(seq); err != nil {
+			ResponseBadRequest(c, err)
+			return
+		}
+	}
+
+	editCount, err := editNote(oid, fields)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+	} else if err == errNoteEdited {
+		ResponseFailure(c, err, http.StatusConflict)
+	} else if err == errStaleEdit {
+		respondNote(c, oid, 0, []string{err.Error()})
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		respondNote(c, oid, editCount, nil)
+	}
+}
+
+// ReadNote marks the note read, or unread with read=false.
+func ReadNote(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	read := true
+	if v := c.PostForm("read"); v != "" {
+		if read, err = strconv.ParseBool(v); err != nil {
+			ResponseBadRequest(c, errors.New("read must be true or false"))
+			return
+		}
+	}
+	editCount, err := setNoteFlag(oid, "read", read)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		respondNote(c, oid, editCount, nil)
+	}
+}
+
+// PinNote pins the note to the top of its book, or unpins it with pinned=false.
+func PinNote(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	pinned := true
+	if v := c.PostForm("pinned"); v != "" {
+		if pinned, err = strconv.ParseBool(v); err != nil {
+			ResponseBadRequest(c, errors.New("pinned must be true or false"))
+			return
+		}
+	}
+	editCount, err := setNoteFlag(oid, "pinned", pinned)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		respondNote(c, oid, editCount, nil)
+	}
+}
+
+// ReadNoteByBook marks every note of the book read.
+func ReadNoteByBook(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("bookid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	editCount, err := readNoteByBook(oid)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errBookNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, editCount)
+	}
+}
+
+// UnlinkNote detaches the note from its book, keeping the note.
+func UnlinkNote(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	editCount, err := unlinkNote(oid)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+	} else if err != nil {
+		ResponseTransactionError(c, err)
+	} else {
+		respondNote(c, oid, editCount, nil)
+	}
+}
+
+// ListUnlinkedNote pages through the notes belonging to no book, newest first
+// unless order=asc, Total counting them across every page.
+func ListUnlinkedNote(c *gin.Context) {
+	skip, limit, err := parsePage(c)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	total, err := countNote(unlinkedNoteFilter)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	notes, err := listAllNote(unlinkedNoteFilter, skip, limit, c.Query("order") == "asc")
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseList(c, notes, total)
+	}
+}
+
+// ListReplies lists the direct replies to a note, Total counting them.
+func ListReplies(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	parent, err := getNote(oid)
+	if err != nil {
+		ResponseError(c, err)
+		return
+	}
+	if parent.ID.IsZero() {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+		return
+	}
+	replies, err := listReplies(oid)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseList(c, replies, int64(len(replies)))
+	}
+}
+
+// GetNoteStats ranks the books by number of notes, limit defaults to 10, at most 100.
+func GetNoteStats(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultNoteStats)))
+	if err != nil || limit < 1 {
+		ResponseBadRequest(c, errors.New("limit must be a positive number"))
+		return
+	}
+	if limit > maxNoteStats {
+		limit = maxNoteStats
+	}
+	counts, err := noteCountByBook(int64(limit))
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, counts)
+	}
+}
+
+// GetNotePath lists the ancestors of a reply, root first, for breadcrumbs.
+func GetNotePath(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	note, err := getNote(oid)
+	if err != nil {
+		ResponseError(c, err)
+		return
+	}
+	if note.ID.IsZero() {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+		return
+	}
+	path, err := notePath(note)
+	if err != nil {
+		ResponseBadRequest(c, err)
+	} else {
+		ResponseSuccess(c, path)
+	}
+}
+
+func GetNoteHistory(c *gin.Context) {
+	oid, err := primitive.ObjectIDFromHex(c.Param("noteid"))
+	if err != nil {
+		logErrorf("request_id=%s invalid id: %v", RequestID(c), err)
+		ResponseBadRequest(c, err)
+		return
+	}
+	note, err := getNote(oid)
+	if err != nil {
+		ResponseError(c, err)
+		return
+	}
+	if note.ID.IsZero() {
+		ResponseFailure(c, errNoteNotFound, http.StatusNotFound)
+		return
+	}
+	ResponseSuccess(c, note.History)
+}
+
+// Goal
+func SetGoal(c *gin.Context) {
+	year, err := strconv.Atoi(c.PostForm("year"))
+	if err != nil || year <= 0 {
+		ResponseBadRequest(c, errors.New("invalid year"))
+		return
+	}
+	target, err := strconv.Atoi(c.PostForm("target"))
+	if err != nil || target <= 0 {
+		ResponseBadRequest(c, errors.New("target must be a positive number"))
+		return
+	}
+	goal := Goal{
+		Year:   year,
+		Target: target,
+	}
+	if err := setGoal(goal); err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	ResponseSuccess(c, goal)
+}
+
+func GetGoal(c *gin.Context) {
+	year, err := strconv.Atoi(c.Param("year"))
+	if err != nil {
+		ResponseBadRequest(c, errors.New("invalid year"))
+		return
+	}
+	goal, err := getGoal(year)
+	if err == mongo.ErrNoDocuments {
+		ResponseFailure(c, errors.New("no goal set for this year"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	// tz=Europe/Paris counts late-night finishes on the right side of new year
+	loc, err := parseTZ(c)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	finished, err := countFinished(year, loc)
+	if err != nil {
+		ResponseBadRequest(c, err)
+		return
+	}
+	ResponseSuccess(c, GoalProgress{
+		Goal:     goal,
+		Finished: finished,
+		Percent:  float64(finished) / float64(goal.Target) * 100,
+	})
+}
@@ -0,0 +1,547 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// getTestBook gets a book through the API.
+func getTestBook(t *testing.T, h http.Handler, id primitive.ObjectID) Book {
+	t.Helper()
+	w, resp := send(t, h, "GET", "/book/"+id.Hex(), nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /book/%s: %d %s", id.Hex(), w.Code, w.Body.String())
+	}
+	var book Book
+	decode(t, resp, &book)
+	return book
+}
+
+func TestEditBookIgnoresBodyID(t *testing.T) {
+	h := newTestService(t)
+	other := addTestBook(t, h, url.Values{"title": {"Other"}, "status": {"0"}})
+
+	tests := []struct {
+		name   string
+		bodyID string
+	}{
+		{"another book", other.ID.Hex()},
+		{"unknown id", primitive.NewObjectID().Hex()},
+		{"not an id", "not-an-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := addTestBook(t, h, url.Values{"title": {"Path"}, "status": {"0"}})
+
+			target := "/book/" + book.ID.Hex()
+			w, _ := send(t, h, "PATCH", target, url.Values{"id": {tt.bodyID}, "title": {"Edited"}}, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("PATCH %s: %d %s", target, w.Code, w.Body.String())
+			}
+			if got := getTestBook(t, h, book.ID); got.ID != book.ID || got.Title != "Edited" {
+				t.Errorf("path book = %s %q, want %s %q", got.ID.Hex(), got.Title, book.ID.Hex(), "Edited")
+			}
+			if got := getTestBook(t, h, other.ID); got.Title != "Other" {
+				t.Errorf("other book title = %q, want it untouched", got.Title)
+			}
+		})
+	}
+}
+
+func TestAddBookReadingTimes(t *testing.T) {
+	h := newTestService(t)
+	tests := []struct {
+		name       string
+		start, end string
+		wantCode   int
+	}{
+		{"no times", "", "", http.StatusOK},
+		{"only start", "2021-03-01 00:00:00", "", http.StatusOK},
+		{"only end", "", "2021-03-01 00:00:00", http.StatusOK},
+		{"end after start", "2021-03-01 00:00:00", "2021-03-04 00:00:00", http.StatusOK},
+		{"end before start", "2021-03-04 00:00:00", "2021-03-01 00:00:00", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"title": {"Times"}, "startTime": {tt.start}, "endTime": {tt.end}}
+			w, resp := send(t, h, "POST", "/book", form, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == http.StatusBadRequest {
+				if len(resp.Errors) != 1 || resp.Errors[0].Field != "endTime" {
+					t.Errorf("errors = %+v, want one on endTime", resp.Errors)
+				}
+			}
+		})
+	}
+}
+
+func TestEditBookReadingTimes(t *testing.T) {
+	h := newTestService(t)
+	tests := []struct {
+		name     string
+		stored   url.Values
+		edit     url.Values
+		wantCode int
+	}{
+		{"end after the stored start", url.Values{"startTime": {"2021-03-01 00:00:00"}},
+			url.Values{"endTime": {"2021-03-04 00:00:00"}}, http.StatusOK},
+		{"end before the stored start", url.Values{"startTime": {"2021-03-04 00:00:00"}},
+			url.Values{"endTime": {"2021-03-01 00:00:00"}}, http.StatusBadRequest},
+		{"start after the stored end", url.Values{"endTime": {"2021-03-01 00:00:00"}},
+			url.Values{"startTime": {"2021-03-04 00:00:00"}}, http.StatusBadRequest},
+		{"both moved together", url.Values{"startTime": {"2021-03-01 00:00:00"}, "endTime": {"2021-03-04 00:00:00"}},
+			url.Values{"startTime": {"2021-04-01 00:00:00"}, "endTime": {"2021-04-04 00:00:00"}}, http.StatusOK},
+		{"end before start in the edit", url.Values{},
+			url.Values{"startTime": {"2021-03-04 00:00:00"}, "endTime": {"2021-03-01 00:00:00"}}, http.StatusBadRequest},
+		{"no stored times", url.Values{}, url.Values{"endTime": {"2021-03-01 00:00:00"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stored.Set("title", "Times")
+			book := addTestBook(t, h, tt.stored)
+
+			target := "/book/" + book.ID.Hex()
+			w, _ := send(t, h, "PATCH", target, tt.edit, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				if got := getTestBook(t, h, book.ID); !got.StartTime.Equal(book.StartTime) || !got.EndTime.Equal(book.EndTime) {
+					t.Errorf("times = %v %v after a rejected edit, want %v %v", got.StartTime, got.EndTime, book.StartTime, book.EndTime)
+				}
+			}
+		})
+	}
+}
+
+func TestListBookPageHeaders(t *testing.T) {
+	h := newTestService(t)
+	for i := 0; i < 3; i++ {
+		addTestBook(t, h, url.Values{"title": {"To read"}, "status": {"to_read"}})
+	}
+	for i := 0; i < 2; i++ {
+		addTestBook(t, h, url.Values{"title": {"Reading"}, "status": {"reading"}})
+	}
+	addTestBook(t, h, url.Values{"title": {"Draft"}, "isDraft": {"true"}})
+
+	tests := []struct {
+		name                  string
+		query                 string
+		total, page, pageSize string
+		items                 int
+	}{
+		{"no page asked for", "", "5", "1", "20", 5},
+		{"nothing found", "?status=finished", "0", "1", "20", 0},
+		{"first page", "?page=1&pageSize=2", "5", "1", "2", 2},
+		{"last page", "?page=3&pageSize=2", "5", "3", "2", 1},
+		{"past the last page", "?page=4&pageSize=2", "5", "4", "2", 0},
+		{"default page size", "?page=1", "5", "1", "20", 5},
+		{"page size capped", "?pageSize=1000", "5", "1", "100", 5},
+		{"filtered", "?status=reading&pageSize=1", "2", "1", "1", 1},
+		{"with drafts", "?includeDrafts=true", "6", "1", "20", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, "GET", "/book"+tt.query, nil, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /book%s: %d %s", tt.query, w.Code, w.Body.String())
+			}
+			for header, want := range map[string]string{
+				"X-Total-Count": tt.total,
+				"X-Page":        tt.page,
+				"X-Page-Size":   tt.pageSize,
+			} {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+			var books []Book
+			decode(t, resp, &books)
+			if len(books) != tt.items {
+				t.Errorf("got %d books, want %d", len(books), tt.items)
+			}
+		})
+	}
+}
+
+func TestGetBookETag(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Tagged"}, "totalPages": {"300"}})
+	note := addTestNote(t, h, book.ID, nil)
+	target := "/book/" + book.ID.Hex()
+
+	etag := func(query string) string {
+		t.Helper()
+		w, _ := send(t, h, "GET", target+query, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s%s: %d %s", target, query, w.Code, w.Body.String())
+		}
+		return w.Header().Get("ETag")
+	}
+	plain := etag("")
+	withNotes := etag("?withNotes=true")
+	for query, other := range map[string]string{
+		"?pagesPerHour=10": etag("?pagesPerHour=10"),
+		"?withNotes=true":  withNotes,
+	} {
+		if other == "" || other == plain {
+			t.Errorf("ETag of %s = %q, want one other than %q", query, other, plain)
+		}
+	}
+
+	w, _ := send(t, h, "GET", target+"?withNotes=true", nil, http.Header{"If-None-Match": {withNotes}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("GET with a matching ETag: %d, want %d", w.Code, http.StatusNotModified)
+	}
+	w, _ = send(t, h, "PATCH", "/note/"+note.ID.Hex(), url.Values{"content": {"edited"}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH /note/%s: %d %s", note.ID.Hex(), w.Code, w.Body.String())
+	}
+	if got := etag("?withNotes=true"); got == withNotes {
+		t.Errorf("ETag with notes unchanged after editing a note")
+	}
+}
+
+func TestEditBookStatusTransition(t *testing.T) {
+	h := newTestService(t)
+	tests := []struct {
+		from, to string
+		wantCode int
+	}{
+		{"to_read", "reading", http.StatusOK},
+		{"reading", "finished", http.StatusOK},
+		{"to_read", "finished", http.StatusBadRequest},
+		{"finished", "reading", http.StatusBadRequest},
+		{"abandoned", "reading", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			book := addTestBook(t, h, url.Values{"title": {"Status"}, "status": {tt.from}})
+			target := "/book/" + book.ID.Hex()
+			w, _ := send(t, h, "PATCH", target, url.Values{"status": {tt.to}}, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			want := tt.to
+			if tt.wantCode != http.StatusOK {
+				want = tt.from
+			}
+			if got := getTestBook(t, h, book.ID); statusName(got.Status) != want {
+				t.Errorf("stored status = %s, want %s", statusName(got.Status), want)
+			}
+		})
+	}
+}
+
+func TestEditBookStatusBatch(t *testing.T) {
+	h := newTestService(t)
+	tests := []struct {
+		name     string
+		from     []string
+		to       string
+		edited   int
+		rejected []int
+	}{
+		{"all allowed", []string{"to_read", "to_read"}, "reading", 2, nil},
+		{"some rejected", []string{"reading", "to_read", "finished"}, "finished", 1, []int{1}},
+		{"already there", []string{"reading", "reading"}, "reading", 0, nil},
+		{"all rejected", []string{"finished", "abandoned"}, "to_read", 0, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var books []Book
+			form := url.Values{"status": {tt.to}}
+			for _, status := range tt.from {
+				book := addTestBook(t, h, url.Values{"title": {"Batch"}, "status": {status}})
+				books = append(books, book)
+				form.Add("ids", book.ID.Hex())
+			}
+			missing := primitive.NewObjectID()
+			form.Add("ids", missing.Hex())
+
+			w, resp := send(t, h, "POST", "/book/batch/status", form, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			var batch StatusBatch
+			decode(t, resp, &batch)
+			if batch.Edited != tt.edited {
+				t.Errorf("edited = %d, want %d", batch.Edited, tt.edited)
+			}
+
+			rejected := map[primitive.ObjectID]bool{}
+			for _, r := range batch.Rejected {
+				rejected[r.ID] = true
+			}
+			if !rejected[missing] {
+				t.Errorf("rejected = %+v, want the unknown id in it", batch.Rejected)
+			}
+			if len(batch.Rejected) != len(tt.rejected)+1 {
+				t.Errorf("rejected = %+v, want %d books and the unknown id", batch.Rejected, len(tt.rejected))
+			}
+			for _, i := range tt.rejected {
+				if !rejected[books[i].ID] {
+					t.Errorf("book %d wasn't rejected", i)
+				}
+				if got := getTestBook(t, h, books[i].ID); statusName(got.Status) != tt.from[i] {
+					t.Errorf("book %d status = %s, want it left at %s", i, statusName(got.Status), tt.from[i])
+				}
+			}
+			for i, book := range books {
+				if !rejected[book.ID] {
+					if got := getTestBook(t, h, book.ID); statusName(got.Status) != tt.to {
+						t.Errorf("book %d status = %s, want %s", i, statusName(got.Status), tt.to)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateISBN(t *testing.T) {
+	h := newTestService(t)
+	taken := addTestBook(t, h, url.Values{"title": {"Taken"}, "isbn": {"978-0-13-110362-7"}})
+	if !hasBookIndex(t, "isbn_1") {
+		t.Skip("the server couldn't create the unique isbn index")
+	}
+	other := addTestBook(t, h, url.Values{"title": {"Other"}, "isbn": {"9780262033848"}})
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		form     url.Values
+		wantCode int
+	}{
+		{"add with a taken isbn", "POST", "/book", url.Values{"title": {"Again"}, "isbn": {"9780131103627"}}, http.StatusConflict},
+		{"add with a free isbn", "POST", "/book", url.Values{"title": {"Free"}, "isbn": {"9781593272203"}}, http.StatusOK},
+		{"add without isbn", "POST", "/book", url.Values{"title": {"None"}}, http.StatusOK},
+		{"edit to a taken isbn", "PATCH", "/book/" + other.ID.Hex(), url.Values{"isbn": {taken.ISBN}}, http.StatusConflict},
+		{"edit keeping its isbn", "PATCH", "/book/" + taken.ID.Hex(), url.Values{"isbn": {taken.ISBN}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, tt.method, tt.target, tt.form, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("%s %s: %d, want %d: %s", tt.method, tt.target, w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == http.StatusConflict && resp.Error != "isbn is already used by another book" {
+				t.Errorf("error = %q, want it to name isbn", resp.Error)
+			}
+		})
+	}
+}
+
+// hasBookIndex tells whether the book collection has the index called name.
+func hasBookIndex(t *testing.T, name string) bool {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cursor, err := testClient(t).Database(database.Name).Collection(database.BookCollection).Indexes().List(ctx)
+	if err != nil {
+		t.Fatalf("listing indexes: %v", err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		t.Fatalf("listing indexes: %v", err)
+	}
+	for _, index := range indexes {
+		if index.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReplaceBook(t *testing.T) {
+	h := newTestService(t)
+	full := url.Values{
+		"title":       {"Full"},
+		"status":      {"reading"},
+		"author":      {"Ann Author"},
+		"description": {"a description"},
+		"series":      {"A Series"},
+		"seriesOrder": {"2"},
+		"tags":        {"one", "two"},
+		"rating":      {"4"},
+		"totalPages":  {"300"},
+		"startTime":   {"2021-03-01 00:00:00"},
+	}
+	tests := []struct {
+		name     string
+		form     url.Values
+		wantCode int
+		check    func(t *testing.T, got Book)
+	}{
+		{"omitted fields are cleared", url.Values{"title": {"Replaced"}, "status": {"reading"}}, http.StatusOK, func(t *testing.T, got Book) {
+			if got.Title != "Replaced" || got.Author != "" || len(got.Authors) != 0 || got.Description != "" ||
+				got.Series != "" || got.SeriesOrder != 0 || len(got.Tags) != 0 || got.ISBN != "" ||
+				got.Rating != nil || got.TotalPages != 0 || !got.StartTime.IsZero() {
+				t.Errorf("got %+v, want every optional field cleared", got)
+			}
+		}},
+		{"sent fields are kept", url.Values{"title": {"Replaced"}, "status": {"reading"}, "tags": {"three"}, "rating": {"2"}}, http.StatusOK, func(t *testing.T, got Book) {
+			if len(got.Tags) != 1 || got.Tags[0] != "three" || got.Rating == nil || *got.Rating != 2 || got.Description != "" {
+				t.Errorf("got tags %q rating %v description %q, want [three] 2 and no description", got.Tags, got.Rating, got.Description)
+			}
+		}},
+		{"title is required", url.Values{"status": {"reading"}}, http.StatusBadRequest, nil},
+		{"status is required", url.Values{"title": {"Replaced"}}, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// ISBNs are unique, and a rejected PUT keeps the book's
+			full.Set("isbn", primitive.NewObjectID().Hex())
+			book := addTestBook(t, h, full)
+			note := addTestNote(t, h, book.ID, nil)
+			book = getTestBook(t, h, book.ID)
+
+			target := "/book/" + book.ID.Hex()
+			w, resp := send(t, h, "PUT", target, tt.form, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("PUT %s: %d, want %d: %s", target, w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				if got := getTestBook(t, h, book.ID); got.Title != "Full" {
+					t.Errorf("title = %q after a rejected PUT, want it unchanged", got.Title)
+				}
+				return
+			}
+			var returned Book
+			decode(t, resp, &returned)
+			stored := getTestBook(t, h, book.ID)
+			for name, got := range map[string]Book{"returned": returned, "stored": stored} {
+				t.Run(name, func(t *testing.T) {
+					tt.check(t, got)
+					if got.ID != book.ID || !got.CreatedAt.Equal(book.CreatedAt) {
+						t.Errorf("id %s createdAt %v, want %s %v", got.ID.Hex(), got.CreatedAt, book.ID.Hex(), book.CreatedAt)
+					}
+					if len(got.Notes) != 1 || got.Notes[0] != note.ID {
+						t.Errorf("notes = %v, want the note kept", got.Notes)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestWritesReturnTheBook(t *testing.T) {
+	h := newTestService(t)
+	tests := []struct {
+		name     string
+		method   string
+		target   func(id primitive.ObjectID) string
+		form     url.Values
+		wantCode int
+		check    func(t *testing.T, got Book)
+	}{
+		{"add", "POST", func(primitive.ObjectID) string { return "/book" },
+			url.Values{"title": {"The Left Hand of Darkness"}, "status": {"0"}}, http.StatusOK,
+			func(t *testing.T, got Book) {
+				if got.Title != "The Left Hand of Darkness" {
+					t.Errorf("title = %q", got.Title)
+				}
+			}},
+		{"edit", "PATCH", func(id primitive.ObjectID) string { return "/book/" + id.Hex() },
+			url.Values{"description": {"edited"}}, http.StatusOK,
+			func(t *testing.T, got Book) {
+				if got.Description != "edited" || got.Title != "Existing" {
+					t.Errorf("title %q description %q, want the edit on the stored book", got.Title, got.Description)
+				}
+			}},
+		{"edit a missing book", "PATCH", func(primitive.ObjectID) string { return "/book/" + primitive.NewObjectID().Hex() },
+			url.Values{"description": {"edited"}}, http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := addTestBook(t, h, url.Values{"title": {"Existing"}, "status": {"0"}})
+			w, resp := send(t, h, tt.method, tt.target(existing.ID), tt.form, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("%s: %d, want %d: %s", tt.method, w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				if resp.Success || resp.Error != errBookNotFound.Error() {
+					t.Errorf("envelope = %+v, want the book not found error", resp)
+				}
+				return
+			}
+			var got Book
+			decode(t, resp, &got)
+			tt.check(t, got)
+			// the fields only the server sets come back too
+			if got.ID.IsZero() || got.CreatedAt.IsZero() || got.UpdatedAt.IsZero() || got.Slug == "" {
+				t.Errorf("id %s createdAt %v updatedAt %v slug %q, want them set",
+					got.ID.Hex(), got.CreatedAt, got.UpdatedAt, got.Slug)
+			}
+		})
+	}
+}
+
+func TestWritesPreferMinimal(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Minimal"}, "status": {"0"}})
+	note := addTestNote(t, h, book.ID, nil)
+
+	finds := func() uint64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		if hist := metrics.mongoLatency["find"]; hist != nil {
+			return hist.count
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		form   url.Values
+	}{
+		{"book", "/book/" + book.ID.Hex(), url.Values{"description": {"edited"}}},
+		{"note", "/note/" + note.ID.Hex() + "/pin", url.Values{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "PATCH"
+			if strings.HasSuffix(tt.target, "/pin") {
+				method = "POST"
+			}
+			// the same write sent twice, reading its result back only the first time
+			sent := make(map[string]uint64)
+			for _, prefer := range []string{"", "return=minimal"} {
+				// so both start with the book to read from the database
+				bookCache.invalidate(book.ID)
+				before := finds()
+				w, resp := send(t, h, method, tt.target, tt.form, http.Header{"Prefer": {prefer}})
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s %s: %d %s", method, tt.target, w.Code, w.Body.String())
+				}
+				sent[prefer] = finds() - before
+				if prefer == "" {
+					continue
+				}
+				if got := w.Header().Get("Preference-Applied"); got != prefer {
+					t.Errorf("Preference-Applied = %q", got)
+				}
+				var count int64
+				decode(t, resp, &count)
+				if count != 0 && count != 1 {
+					t.Errorf("answered %s, want the edit count", resp.Data)
+				}
+			}
+			if sent["return=minimal"] != sent[""]-1 {
+				t.Errorf("sent %d find commands, %d without the preference, want the write not read back",
+					sent["return=minimal"], sent[""])
+			}
+		})
+	}
+}
@@ -1,154 +1,1082 @@
 package tracker
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
-	db      = "tracker"
-	bookCol = "book"
+	msPerDay = 24 * 60 * 60 * 1000
 )
 
 // Book
-func listBook(query map[string]string) (books []Book, err error) {
-	client, ctx, cancel := getConnection()
+func listBook(filter bson.D, opts ...*options.FindOptions) (books []Book, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return books, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(bookCol)
+	collection := client.Database(database.Name).Collection(database.BookCollection)
 
-	listAll := true
-	for _, v := range query {
-		if v != "" {
-			listAll = false
-		}
+	if filter == nil {
+		filter = bson.D{}
 	}
-	if listAll == true {
-		cursor, err := collection.Find(ctx, bson.M{})
-		if err != nil {
-			log.Fatal(err)
-			return books, err
-		}
-		defer cursor.Close(ctx)
+	logDebugf("filter: %v", filter)
 
-		for cursor.Next(ctx) {
-			var book Book
-			if err = cursor.Decode(&book); err != nil {
-				log.Fatal(err)
-				return books, err
-			} else {
-				books = append(books, book)
-			}
-		}
-		return books, nil
-	} else {
-		var filter bson.D
-		for k, v := range query {
-			if v != "" {
-				fmt.Println(v)
-				if err != nil {
-					log.Fatal(err)
-				}
-				filter = append(filter, bson.E{k, v})
-			}
-		}
-		cursor, err := collection.Find(ctx, filter)
-		if err != nil {
-			fmt.Println("error 1")
-			log.Fatal(err)
-			return books, err
-		}
-		defer cursor.Close(ctx)
+	var cursor *mongo.Cursor
+	err = retryRead(ctx, func() (err error) {
+		cursor, err = collection.Find(ctx, filter, opts...)
+		return err
+	})
+	if err != nil {
+		logErrorf("%v", err)
+		return books, err
+	}
+	defer cursor.Close(ctx)
 
-		for cursor.Next(ctx) {
-			var book Book
-			if err = cursor.Decode(&book); err != nil {
-				log.Fatal(err)
-				return books, err
-			} else {
-				books = append(books, book)
-			}
+	for cursor.Next(ctx) {
+		var book Book
+		// one malformed book, e.g. mid-migration, doesn't fail the whole list
+		if err := cursor.Decode(&book); err != nil {
+			logErrorf("skipping book %v: %v", cursor.Current.Lookup("id"), err)
+			continue
 		}
-		return books, nil
+		book.afterRead()
+		books = append(books, book)
+	}
+	if err = cursor.Err(); err != nil {
+		logErrorf("%v", err)
+		return books, err
+	}
+	return books, nil
+}
+
+func countBook(filter bson.D) (int64, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	if filter == nil {
+		filter = bson.D{}
+	}
+	var count int64
+	err = retryRead(ctx, func() (err error) {
+		count, err = collection.CountDocuments(ctx, filter)
+		return err
+	})
+	if err != nil {
+		logErrorf("%v", err)
 	}
+	return count, err
 }
 
 func getBook(bookID primitive.ObjectID) (book Book, err error) {
-	client, ctx, cancel := getConnection()
+	if book, ok := bookCache.get(bookID); ok {
+		return book, nil
+	}
+	// taken before reading, an edit invalidating the book meanwhile keeps
+	// the copy read out of the cache
+	generation := bookCache.current()
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return book, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(bookCol)
+	collection := client.Database(database.Name).Collection(database.BookCollection)
 
-	res := collection.FindOne(ctx, bson.M{"id": bookID})
-	res.Decode(&book)
+	err = retryRead(ctx, func() error {
+		return collection.FindOne(ctx, bson.M{"id": bookID}).Decode(&book)
+	})
+	if err == mongo.ErrNoDocuments {
+		return book, nil
+	}
+	if err != nil {
+		logErrorf("Could not get Book: %v", err)
+		return book, err
+	}
 
+	book.afterRead()
+	bookCache.set(book, generation)
 	return book, nil
 }
 
 func addBook(book *Book) (primitive.ObjectID, error) {
-	client, ctx, cancel := getConnection()
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
 	book.ID = primitive.NewObjectID()
+	book.CreatedAt = time.Now()
+	book.UpdatedAt = book.CreatedAt
 
-	collection := client.Database(db).Collection(bookCol)
+	collection := client.Database(database.Name).Collection(database.BookCollection)
 
-	res, err := collection.InsertOne(ctx, book)
+	slug, err := uniqueSlug(ctx, collection, book.Title, book.ID)
 	if err != nil {
-		log.Printf("Could not create Book: %v", err)
+		logErrorf("Could not create Book: %v", err)
 		return primitive.NilObjectID, err
 	}
-	oid := res.InsertedID.(primitive.ObjectID)
-	return oid, nil
+	book.Slug = slug
+
+	// books are looked up by id, the _id mongo generates is never used
+	_, err = collection.InsertOne(ctx, book)
+	if err != nil {
+		logErrorf("Could not create Book: %v", err)
+		return primitive.NilObjectID, err
+	}
+	return book.ID, nil
+}
+
+// Slug of a book whose title has no letter or digit
+const defaultSlug = "book"
+
+// uniqueSlug slugifies the title, adding the first free numeric suffix when
+// another book than id has that slug already, e.g. "dune-2". The unique index
+// on slug catches two books racing for the same one.
+func uniqueSlug(ctx context.Context, collection *mongo.Collection, title string, id primitive.ObjectID) (string, error) {
+	base := slugify(title)
+	if base == "" {
+		base = defaultSlug
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"id":   bson.M{"$ne": id},
+		"slug": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(base) + "(-[0-9]+)?$"},
+	}, options.Find().SetProjection(bson.M{"slug": 1}))
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close(ctx)
+
+	taken := map[string]bool{}
+	for cursor.Next(ctx) {
+		var book Book
+		if err := cursor.Decode(&book); err != nil {
+			return "", err
+		}
+		taken[book.Slug] = true
+	}
+	if err := cursor.Err(); err != nil {
+		return "", err
+	}
+
+	slug := base
+	for n := 2; taken[slug]; n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	return slug, nil
+}
+
+// bookSlug is the slug the book id gets for title, see uniqueSlug.
+func bookSlug(id primitive.ObjectID, title string) (string, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	slug, err := uniqueSlug(ctx, collection, title, id)
+	if err != nil {
+		logErrorf("%v", err)
+	}
+	return slug, err
+}
+
+// getBookBySlug returns the book with the slug, or mongo.ErrNoDocuments.
+func getBookBySlug(slug string) (Book, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return Book{}, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	var book Book
+	err = retryRead(ctx, func() error {
+		return collection.FindOne(ctx, bson.M{"slug": bson.M{"$eq": slug}}).Decode(&book)
+	})
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logErrorf("Could not get Book: %v", err)
+		}
+		return book, err
+	}
+	book.afterRead()
+	return book, nil
 }
 
+// deleteBook deletes the book along with its notes.
 func deleteBook(id primitive.ObjectID) (int, error) {
-	client, ctx, cancel := getConnection()
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(bookCol)
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	// kept for POST /undo
+	book, err := snapshot(ctx, collection, bson.M{"id": id})
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	bookNotes, err := snapshot(ctx, notes, bson.M{"bookid": id})
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
 
 	res, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	bookCache.invalidate(id)
 	if err != nil {
-		log.Fatal(err)
+		logErrorf("%v", err)
+		return 0, err
+	}
+
+	_, err = notes.DeleteMany(ctx, bson.M{"bookid": id})
+	if err != nil {
+		logErrorf("Could not delete the notes of Book %s: %v", id.Hex(), err)
 		return int(res.DeletedCount), err
 	}
+	if res.DeletedCount > 0 && len(book) > 0 {
+		undoBuffer.push(deletion{kind: deletedBook, bookID: id, book: book[0], notes: bookNotes})
+	}
 	return int(res.DeletedCount), nil
 }
 
-func editBook(fields map[string]interface{}) (int, error) {
-	client, ctx, cancel := getConnection()
+// editBook sets the given fields on the book. The id and creation time can
+// never be changed.
+func editBook(id primitive.ObjectID, fields map[string]interface{}) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(bookCol)
+	collection := client.Database(database.Name).Collection(database.BookCollection)
 
 	var updateFields bson.D
 	for k, v := range fields {
+		if k == "id" || k == "createdat" {
+			continue
+		}
 		if v != "" {
-			updateFields = append(updateFields, bson.E{k, v})
+			updateFields = append(updateFields, bson.E{Key: k, Value: v})
 		}
 	}
+	updateFields = append(updateFields, bson.E{Key: "updatedat", Value: time.Now()})
 
 	result, err := collection.UpdateOne(
 		ctx,
-		bson.M{"id": fields["id"]},
+		bson.M{"id": id},
 		bson.D{
-			{"$set", updateFields},
+			{Key: "$set", Value: updateFields},
 		},
 	)
+	bookCache.invalidate(id)
 	if err != nil {
-		log.Fatal(err)
+		logErrorf("%v", err)
 		return 0, err
 	}
 	return int(result.ModifiedCount), nil
 }
 
+// replaceBook overwrites the stored book with book, keyed by its ID. It
+// returns mongo.ErrNoDocuments if there is no such book.
+func replaceBook(book *Book) error {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	book.UpdatedAt = time.Now()
+	res, err := collection.ReplaceOne(ctx, bson.M{"id": book.ID}, book)
+	bookCache.invalidate(book.ID)
+	if err != nil {
+		logErrorf("Could not replace Book: %v", err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// mergeBook moves the notes of the book mergeID to keepID, after keepID's own,
+// and deletes mergeID, in one transaction. keepID takes the cover of mergeID
+// when it has none. It returns how many notes moved, or mongo.ErrNoDocuments
+// if either book doesn't exist.
+func mergeBook(keepID, mergeID primitive.ObjectID) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	books := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	var moved int
+	// the cover only the merged book had, deleted once the merge commits
+	var orphanCover *primitive.ObjectID
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			orphanCover = nil
+			var keep, merge Book
+			if err := books.FindOne(sc, bson.M{"id": keepID}).Decode(&keep); err != nil {
+				return nil, err
+			}
+			if err := books.FindOne(sc, bson.M{"id": mergeID}).Decode(&merge); err != nil {
+				return nil, err
+			}
+
+			res, err := notes.UpdateMany(sc, bson.M{"bookid": mergeID}, bson.M{"$set": bson.M{"bookid": keepID}})
+			if err != nil {
+				return nil, err
+			}
+			moved = int(res.ModifiedCount)
+
+			// the merged notes keep their order, after the kept ones
+			if len(merge.Notes) > 0 {
+				models := make([]mongo.WriteModel, len(merge.Notes))
+				for i, id := range merge.Notes {
+					models[i] = mongo.NewUpdateOneModel().
+						SetFilter(bson.M{"id": id}).
+						SetUpdate(bson.M{"$set": bson.M{"order": len(keep.Notes) + i}})
+				}
+				if _, err := notes.BulkWrite(sc, models); err != nil {
+					return nil, err
+				}
+			}
+
+			set := bson.M{
+				"notes":     append(keep.Notes, merge.Notes...),
+				"updatedat": time.Now(),
+			}
+			// a kept book without a cover takes the merged one
+			if keep.CoverID == nil && merge.CoverID != nil {
+				set["coverid"] = *merge.CoverID
+			} else {
+				orphanCover = merge.CoverID
+			}
+			_, err = books.UpdateOne(sc, bson.M{"id": keepID}, bson.M{"$set": set})
+			if err != nil {
+				return nil, err
+			}
+			_, err = books.DeleteOne(sc, bson.M{"id": mergeID})
+			return nil, err
+		})
+		return err
+	})
+	bookCache.invalidate(keepID)
+	bookCache.invalidate(mergeID)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logErrorf("Could not merge Book %s into %s: %v", mergeID.Hex(), keepID.Hex(), err)
+		}
+		return 0, err
+	}
+	if orphanCover != nil {
+		deleteCover(*orphanCover)
+	}
+	return moved, nil
+}
+
+// publishBook clears the draft flag of the book. It returns
+// mongo.ErrNoDocuments if there is no such book.
+func publishBook(id primitive.ObjectID) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	res, err := collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{
+		"$set": bson.M{"isdraft": false, "updatedat": time.Now()},
+	})
+	bookCache.invalidate(id)
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	if res.MatchedCount == 0 {
+		return 0, mongo.ErrNoDocuments
+	}
+	return int(res.ModifiedCount), nil
+}
+
+var (
+	errAlreadyLent = errors.New("the book is already lent, return it first")
+	errNotLent     = errors.New("the book isn't lent")
+)
+
+// notLent matches books nobody has borrowed.
+var notLent = bson.M{"$in": bson.A{nil, ""}}
+
+// lendBook records that the book was lent to someone at t. It returns
+// errAlreadyLent if the book is lent already.
+func lendBook(id primitive.ObjectID, to string, t time.Time) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	// only a book on the shelf can be lent, checked in the same write
+	res, err := collection.UpdateOne(ctx, bson.M{"id": id, "lentto": notLent}, bson.M{
+		"$set": bson.M{"lentto": to, "lentat": t, "updatedat": time.Now()},
+	})
+	bookCache.invalidate(id)
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	if res.MatchedCount == 0 {
+		return 0, lendingConflict(ctx, collection, id, errAlreadyLent)
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// returnBook puts a lent book back on the shelf. It returns errNotLent if
+// the book isn't lent.
+func returnBook(id primitive.ObjectID) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	res, err := collection.UpdateOne(ctx, bson.M{"id": id, "lentto": bson.M{"$gt": ""}}, bson.M{
+		"$unset": bson.M{"lentto": "", "lentat": ""},
+		"$set":   bson.M{"updatedat": time.Now()},
+	})
+	bookCache.invalidate(id)
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	if res.MatchedCount == 0 {
+		return 0, lendingConflict(ctx, collection, id, errNotLent)
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// lendingConflict tells why a lending update matched nothing: the book is
+// missing or in the wrong state, reported as conflict.
+func lendingConflict(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, conflict error) error {
+	n, err := collection.CountDocuments(ctx, bson.M{"id": id})
+	if err != nil {
+		logErrorf("%v", err)
+		return err
+	}
+	if n == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return conflict
+}
+
+// touchBook records note activity on the book at t.
+func touchBook(id primitive.ObjectID, t time.Time) error {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	_, err = collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$max": bson.M{"lastactivityat": t}})
+	bookCache.invalidate(id)
+	if err != nil {
+		logErrorf("%v", err)
+	}
+	return err
+}
+
 // Note
+
+// listSeries counts the books in every series, by series name.
+func listSeries() (series []SeriesCount, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return series, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"series": bson.M{"$nin": bson.A{"", nil}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$series", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return series, err
+	}
+	if err = cursor.All(ctx, &series); err != nil {
+		logErrorf("%v", err)
+		return series, err
+	}
+	return series, nil
+}
+
+// listSeriesBook returns the books of a series in reading order.
+func listSeriesBook(name string) (books []Book, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return books, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	opts := options.Find().SetSort(bson.M{"seriesorder": 1})
+	cursor, err := collection.Find(ctx, bson.M{"series": name}, opts)
+	if err != nil {
+		logErrorf("%v", err)
+		return books, err
+	}
+	if err = cursor.All(ctx, &books); err != nil {
+		logErrorf("%v", err)
+		return books, err
+	}
+	for i := range books {
+		books[i].afterRead()
+	}
+	return books, nil
+}
+
+var errNotFinished = errors.New("the book isn't finished yet")
+
+// nextInSeries finds the first unfinished book ordered after book, which must
+// be finished, in its series. It returns mongo.ErrNoDocuments when there is none.
+func nextInSeries(book Book) (next Book, err error) {
+	if book.Status != StatusFinished {
+		return next, errNotFinished
+	}
+	if book.Series == "" {
+		return next, mongo.ErrNoDocuments
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return next, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	filter := bson.M{
+		"series":      book.Series,
+		"seriesorder": bson.M{"$gt": book.SeriesOrder},
+		"status":      bson.M{"$nin": bson.A{StatusFinished, StatusAbandoned}},
+	}
+	opts := options.FindOne().SetSort(bson.M{"seriesorder": 1})
+	err = collection.FindOne(ctx, filter, opts).Decode(&next)
+	if err != nil && err != mongo.ErrNoDocuments {
+		logErrorf("%v", err)
+	}
+	next.afterRead()
+	return next, err
+}
+
+// durationStats averages the days taken to read the finished books that have
+// both a start and an end time.
+func durationStats() (stats DurationStats, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return stats, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"status":    StatusFinished,
+			"starttime": bson.M{"$gt": time.Time{}},
+			"endtime":   bson.M{"$gt": time.Time{}},
+			"$expr":     bson.M{"$gte": bson.A{"$endtime", "$starttime"}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": nil,
+			"averageDays": bson.M{"$avg": bson.M{
+				"$divide": bson.A{bson.M{"$subtract": bson.A{"$endtime", "$starttime"}}, msPerDay},
+			}},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+
+	if cursor.Next(ctx) {
+		err = cursor.Decode(&stats)
+	}
+	return stats, err
+}
+
+// randomBook picks one book matching filter, or returns mongo.ErrNoDocuments.
+func randomBook(filter bson.D) (book Book, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return book, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	if filter == nil {
+		filter = bson.D{}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sample", Value: bson.M{"size": 1}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return book, err
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		if err = cursor.Err(); err != nil {
+			return book, err
+		}
+		return book, mongo.ErrNoDocuments
+	}
+	if err = cursor.Decode(&book); err != nil {
+		logErrorf("%v", err)
+		return book, err
+	}
+	book.afterRead()
+	return book, nil
+}
+
+// listAuthor returns up to limit distinct authors starting with prefix,
+// ignoring case, sorted by name.
+func listAuthor(prefix string, limit int) (authors []string, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return authors, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	// co-authors only live in authors, older books only in author
+	seen := make(map[string]bool)
+	for _, field := range []string{"author", "authors"} {
+		values, err := collection.Distinct(ctx, field, bson.M{})
+		if err != nil {
+			logErrorf("%v", err)
+			return authors, err
+		}
+		for _, v := range values {
+			if author, ok := v.(string); ok {
+				seen[author] = true
+			}
+		}
+	}
+
+	authors = []string{}
+	prefix = strings.ToLower(prefix)
+	for author := range seen {
+		if author == "" || !strings.HasPrefix(strings.ToLower(author), prefix) {
+			continue
+		}
+		authors = append(authors, author)
+	}
+	sort.Strings(authors)
+	if len(authors) > limit {
+		authors = authors[:limit]
+	}
+	return authors, nil
+}
+
+// editBookTags adds and removes tags on every book of ids in one update,
+// keeping the order of the tags already there. Books the change leaves as they
+// are aren't touched, so the count is of the books that changed.
+func editBookTags(ids []primitive.ObjectID, add, remove []string) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	// $literal keeps a tag such as "$x" from being read as a field path
+	addTags, removeTags := bson.M{"$literal": add}, bson.M{"$literal": remove}
+	current := bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}
+	kept := bson.M{"$filter": bson.M{
+		"input": current,
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", removeTags}}}},
+	}}
+	added := bson.M{"$filter": bson.M{
+		"input": addTags,
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", current}}}},
+	}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"tags":      bson.M{"$concatArrays": bson.A{kept, added}},
+		"updatedat": time.Now(),
+	}}}}
+
+	// only the books missing a tag to add or holding one to remove
+	var changes bson.A
+	if len(add) > 0 {
+		changes = append(changes, bson.M{"tags": bson.M{"$not": bson.M{"$all": add}}})
+	}
+	if len(remove) > 0 {
+		changes = append(changes, bson.M{"tags": bson.M{"$in": remove}})
+	}
+	filter := bson.M{"id": bson.M{"$in": ids}, "$or": changes}
+
+	result, err := collection.UpdateMany(ctx, filter, update)
+	for _, id := range ids {
+		bookCache.invalidate(id)
+	}
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+// editBookStatus sets the status of many books at once. Books that can't go
+// to status from theirs, see checkTransition, are rejected, the others are
+// edited unless already at status. Books marked finished without an end time
+// get the current time as their end time.
+func editBookStatus(ids []primitive.ObjectID, status int) (batch StatusBatch, err error) {
+	current, err := listBookByID(ids)
+	if err != nil {
+		return batch, err
+	}
+	batch.Rejected = []BookRejection{}
+	for _, id := range current.Missing {
+		batch.Rejected = append(batch.Rejected, BookRejection{ID: id, Error: errBookNotFound.Error()})
+	}
+	var allowed []primitive.ObjectID
+	for _, book := range current.Books {
+		if err := checkTransition(book.Status, status); err != nil {
+			batch.Rejected = append(batch.Rejected, BookRejection{ID: book.ID, Error: err.Error()})
+			continue
+		}
+		allowed = append(allowed, book.ID)
+		if book.Status != status {
+			batch.moved = append(batch.moved, book.ID)
+		}
+	}
+	if len(allowed) == 0 {
+		return batch, nil
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return batch, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	// a book whose status changed since it was checked is left alone
+	from := bson.A{}
+	for previous, next := range statusTransitions {
+		for _, to := range next {
+			if to == status {
+				from = append(from, previous)
+			}
+		}
+	}
+	now := time.Now()
+	if len(batch.moved) > 0 {
+		result, err := collection.UpdateMany(
+			ctx,
+			bson.M{"id": bson.M{"$in": batch.moved}, "status": bson.M{"$in": from}},
+			bson.M{"$set": bson.M{"status": status, "updatedat": now}},
+		)
+		for _, id := range batch.moved {
+			bookCache.invalidate(id)
+		}
+		if err != nil {
+			logErrorf("%v", err)
+			return batch, err
+		}
+		batch.Edited = int(result.ModifiedCount)
+	}
+
+	if status == StatusFinished {
+		_, err = collection.UpdateMany(
+			ctx,
+			bson.M{"id": bson.M{"$in": allowed}, "endtime": bson.M{"$not": bson.M{"$gt": time.Time{}}}},
+			bson.M{"$set": bson.M{"endtime": now}},
+		)
+		for _, id := range allowed {
+			bookCache.invalidate(id)
+		}
+		if err != nil {
+			logErrorf("%v", err)
+			return batch, err
+		}
+	}
+	return batch, nil
+}
+
+// distinctFields maps the fields allowed in distinctBookField to the
+// expression producing their values.
+var distinctFields = map[string]interface{}{
+	// every co-author counts, older books only have author
+	"author": bson.M{"$ifNull": bson.A{"$authors", bson.A{"$author"}}},
+	"status": "$status",
+	"series": "$series",
+}
+
+// distinctBookField counts the books per value of field, most common first.
+func distinctBookField(field string) (counts []FieldCount, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return counts, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{"value": distinctFields[field]}}},
+		{{Key: "$unwind", Value: "$value"}},
+		{{Key: "$match", Value: bson.M{"value": bson.M{"$nin": bson.A{"", nil}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$value", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return counts, err
+	}
+	counts = []FieldCount{}
+	if err = cursor.All(ctx, &counts); err != nil {
+		logErrorf("%v", err)
+		return counts, err
+	}
+	return counts, nil
+}
+
+// topAuthors ranks the authors by finished books, ties by name, keeping the
+// first limit. Every co-author of a book is credited with it.
+func topAuthors(limit int64) (counts []FieldCount, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return counts, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": StatusFinished}}},
+		{{Key: "$project", Value: bson.M{"value": distinctFields["author"]}}},
+		{{Key: "$unwind", Value: "$value"}},
+		{{Key: "$match", Value: bson.M{"value": bson.M{"$nin": bson.A{"", nil}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$value", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return counts, err
+	}
+	counts = []FieldCount{}
+	if err = cursor.All(ctx, &counts); err != nil {
+		logErrorf("%v", err)
+		return counts, err
+	}
+	return counts, nil
+}
+
+// listRecentBook returns the limit most recently added books, newest first.
+func listRecentBook(limit int64) (books []Book, err error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "id", Value: -1}}).
+		SetLimit(limit)
+	return listBook(nil, opts)
+}
+
+// unset matches a time never set, stored as the zero time or not at all
+var unset = bson.M{"$not": bson.M{"$gt": time.Time{}}}
+
+// incompleteChecks are the metadata a book should have: the filter matches the
+// books missing it, missing tells the same of a book read.
+var incompleteChecks = []struct {
+	name    string
+	filter  bson.M
+	missing func(b *Book) bool
+}{
+	{
+		name:    "author",
+		filter:  bson.M{"author": bson.M{"$in": bson.A{nil, ""}}, "authors": bson.M{"$in": bson.A{nil, bson.A{}}}},
+		missing: func(b *Book) bool { return len(b.Authors) == 0 },
+	},
+	{
+		name:    "description",
+		filter:  bson.M{"description": bson.M{"$in": bson.A{nil, ""}}},
+		missing: func(b *Book) bool { return b.Description == "" },
+	},
+	{
+		name:   "startTime",
+		filter: bson.M{"status": bson.M{"$in": bson.A{StatusReading, StatusFinished}}, "starttime": unset},
+		missing: func(b *Book) bool {
+			return (b.Status == StatusReading || b.Status == StatusFinished) && b.StartTime.IsZero()
+		},
+	},
+	{
+		name:    "endTime",
+		filter:  bson.M{"status": StatusFinished, "endtime": unset},
+		missing: func(b *Book) bool { return b.Status == StatusFinished && b.EndTime.IsZero() },
+	},
+	{
+		name:    "rating",
+		filter:  bson.M{"status": StatusFinished, "rating": nil},
+		missing: func(b *Book) bool { return b.Status == StatusFinished && b.Rating == nil },
+	},
+}
+
+// listIncompleteBook lists the books missing any of incompleteChecks, oldest
+// first. Drafts are left out, they are incomplete on purpose.
+func listIncompleteBook() ([]IncompleteBook, error) {
+	anyMissing := bson.A{}
+	for _, check := range incompleteChecks {
+		anyMissing = append(anyMissing, check.filter)
+	}
+	filter := bson.D{
+		{Key: "$or", Value: anyMissing},
+		{Key: "isdraft", Value: bson.M{"$ne": true}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}, {Key: "id", Value: 1}})
+	books, err := listBook(filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	incomplete := make([]IncompleteBook, 0, len(books))
+	for i := range books {
+		book := IncompleteBook{Book: books[i], Missing: []string{}}
+		for _, check := range incompleteChecks {
+			if check.missing(&books[i]) {
+				book.Missing = append(book.Missing, check.name)
+			}
+		}
+		incomplete = append(incomplete, book)
+	}
+	return incomplete, nil
+}
+
+// listBookByID fetches the books in one query, in the order of ids.
+func listBookByID(ids []primitive.ObjectID) (batch BookBatch, err error) {
+	found, err := listBook(bson.D{{Key: "id", Value: bson.M{"$in": ids}}})
+	if err != nil {
+		return batch, err
+	}
+
+	byID := make(map[primitive.ObjectID]Book, len(found))
+	for _, book := range found {
+		byID[book.ID] = book
+	}
+	batch.Books = []Book{}
+	batch.Missing = []primitive.ObjectID{}
+	for _, id := range ids {
+		if book, ok := byID[id]; ok {
+			batch.Books = append(batch.Books, book)
+		} else {
+			batch.Missing = append(batch.Missing, id)
+		}
+	}
+	return batch, nil
+}
+
+// searchBook finds up to limit books whose title, author or description
+// contains q, ignoring case, most recently updated first. Drafts are left out.
+func searchBook(q string, limit int64) ([]Book, error) {
+	pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+	filter := bson.D{
+		{Key: "$or", Value: bson.A{
+			bson.M{"title": pattern},
+			bson.M{"author": pattern},
+			bson.M{"authors": pattern},
+			bson.M{"description": pattern},
+		}},
+		{Key: "isdraft", Value: bson.M{"$ne": true}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updatedat", Value: -1}}).
+		SetLimit(limit)
+	return listBook(filter, opts)
+}
+
+// Score at most N titles in a fuzzy search
+const fuzzyCandidateLimit = 5000
+
+// fuzzySearchBook ranks the books by how close their title is to q, keeping
+// up to limit books scoring at least minFuzzyScore. Drafts are left out.
+func fuzzySearchBook(q string, limit int) ([]ScoredBook, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updatedat", Value: -1}}).
+		SetLimit(fuzzyCandidateLimit)
+	books, err := listBook(bson.D{{Key: "isdraft", Value: bson.M{"$ne": true}}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	scored := []ScoredBook{}
+	for _, book := range books {
+		if score := titleScore(q, book.Title); score >= minFuzzyScore {
+			scored = append(scored, ScoredBook{Book: book, Score: score})
+		}
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+	if len(scored) > limit {
+		scored = scored[:limit]
+	}
+	return scored, nil
+}
@@ -0,0 +1,136 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// countNotes counts the stored notes matching filter.
+func countNotes(t *testing.T, filter interface{}) int64 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := testClient(t).Database(database.Name).Collection(database.NoteCollection).CountDocuments(ctx, filter)
+	if err != nil {
+		t.Fatalf("counting notes: %v", err)
+	}
+	return n
+}
+
+func TestDeleteBookDeletesItsNotes(t *testing.T) {
+	h := newTestService(t)
+	kept := addTestBook(t, h, url.Values{"title": {"Kept"}, "status": {"0"}})
+	keptNote := addTestNote(t, h, kept.ID, nil)
+
+	tests := []struct {
+		name  string
+		notes int
+	}{
+		{"no notes", 0},
+		{"one note", 1},
+		{"several notes", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := addTestBook(t, h, url.Values{"title": {"Deleted"}, "status": {"0"}})
+			for i := 0; i < tt.notes; i++ {
+				addTestNote(t, h, book.ID, nil)
+			}
+			if got := countNotes(t, bson.M{"bookid": book.ID}); got != int64(tt.notes) {
+				t.Fatalf("stored %d notes, want %d", got, tt.notes)
+			}
+
+			w, _ := sendMultipart(t, h, "DELETE", "/book", url.Values{"id": {book.ID.Hex()}})
+			if w.Code != http.StatusOK {
+				t.Fatalf("DELETE /book: %d %s", w.Code, w.Body.String())
+			}
+			if got := countNotes(t, bson.M{"bookid": book.ID}); got != 0 {
+				t.Errorf("%d notes left after deleting their book", got)
+			}
+			if got := countNotes(t, bson.M{"id": keptNote.ID}); got != 1 {
+				t.Errorf("the note of another book was deleted")
+			}
+		})
+	}
+}
+
+func TestSearchBookLeavesOutDrafts(t *testing.T) {
+	h := newTestService(t)
+	published := addTestBook(t, h, url.Values{"title": {"Dune Messiah"}})
+	addTestBook(t, h, url.Values{"title": {"Dune Messiah"}, "isDraft": {"true"}})
+
+	tests := []struct {
+		name   string
+		search func() ([]Book, error)
+	}{
+		{"search", func() ([]Book, error) { return searchBook("dune", 10) }},
+		{"fuzzy search", func() ([]Book, error) {
+			scored, err := fuzzySearchBook("dune mesiah", 10)
+			books := make([]Book, len(scored))
+			for i := range scored {
+				books[i] = scored[i].Book
+			}
+			return books, err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, err := tt.search()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(books) != 1 || books[0].ID != published.ID {
+				t.Errorf("found %d books, want only the published one", len(books))
+			}
+		})
+	}
+}
+
+func TestLendAndReturnBook(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Lent"}})
+	target := "/book/" + book.ID.Hex()
+
+	steps := []struct {
+		name     string
+		target   string
+		form     url.Values
+		wantCode int
+		wantLent bool
+	}{
+		{"on the shelf", "", nil, http.StatusOK, false},
+		{"lend", "/lend", url.Values{"to": {"Shevek"}}, http.StatusOK, true},
+		{"lend again", "/lend", url.Values{"to": {"Takver"}}, http.StatusConflict, true},
+		{"return", "/return", url.Values{}, http.StatusOK, false},
+		{"return again", "/return", url.Values{}, http.StatusConflict, false},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if step.form != nil {
+				w, _ := send(t, h, "POST", target+step.target, step.form, nil)
+				if w.Code != step.wantCode {
+					t.Fatalf("POST %s: %d, want %d: %s", step.target, w.Code, step.wantCode, w.Body.String())
+				}
+			}
+			w, resp := send(t, h, "GET", target, nil, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s: %d %s", target, w.Code, w.Body.String())
+			}
+			// a book nobody borrowed has no lentAt at all, not a zero time
+			var fields map[string]json.RawMessage
+			decode(t, resp, &fields)
+			if _, ok := fields["lentAt"]; ok != step.wantLent {
+				t.Errorf("lentAt sent = %v, want %v: %s", ok, step.wantLent, resp.Data)
+			}
+			if _, ok := fields["lentTo"]; ok != step.wantLent {
+				t.Errorf("lentTo sent = %v, want %v: %s", ok, step.wantLent, resp.Data)
+			}
+		})
+	}
+}
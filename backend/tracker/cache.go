@@ -0,0 +1,154 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Books served by getBook are kept in the cache of the Service, see
+// NewService. Until there is one nothing is cached.
+var bookCache = newBookCache(0, 0)
+
+type bookCacheEntry struct {
+	book    Book
+	expires time.Time
+}
+
+type bookTTLCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[primitive.ObjectID]bookCacheEntry
+	// bumped by every invalidate, so a book read before one isn't stored after it
+	generation uint64
+}
+
+func newBookCache(ttl time.Duration, size int) *bookTTLCache {
+	return &bookTTLCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[primitive.ObjectID]bookCacheEntry),
+	}
+}
+
+func (c *bookTTLCache) get(id primitive.ObjectID) (Book, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return Book{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, id)
+		return Book{}, false
+	}
+	return entry.book.clone(), true
+}
+
+// current returns the generation to pass to set along with a book read from
+// the database afterwards.
+func (c *bookTTLCache) current() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// set caches the book read during generation, unless a book was invalidated
+// since, the copy read may then be stale.
+func (c *bookTTLCache) set(book Book, generation uint64) {
+	if c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.entries[book.ID]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[book.ID] = bookCacheEntry{
+		book:    book.clone(),
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+func (c *bookTTLCache) invalidate(id primitive.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+	c.generation++
+}
+
+// evict drops expired entries, or the one closest to expiring if none are.
+// Callers must hold c.mu.
+func (c *bookTTLCache) evict() {
+	now := time.Now()
+	var oldest primitive.ObjectID
+	var oldestExpires time.Time
+	for id, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, id)
+			continue
+		}
+		if oldestExpires.IsZero() || entry.expires.Before(oldestExpires) {
+			oldest, oldestExpires = id, entry.expires
+		}
+	}
+	if len(c.entries) >= c.size {
+		delete(c.entries, oldest)
+	}
+}
+
+// clone copies the book along with what its slices and pointers refer to, so
+// a caller changing its copy, e.g. appending a note, leaves the cache alone.
+func (b Book) clone() Book {
+	b.Authors = cloneStrings(b.Authors)
+	b.Tags = cloneStrings(b.Tags)
+	if b.Notes != nil {
+		b.Notes = append(make([]primitive.ObjectID, 0, len(b.Notes)), b.Notes...)
+	}
+	b.Rating = cloneInt(b.Rating)
+	b.DaysToRead = cloneInt(b.DaysToRead)
+	b.RereadOf = cloneObjectID(b.RereadOf)
+	b.CoverID = cloneObjectID(b.CoverID)
+	if b.LentAt != nil {
+		lentAt := *b.LentAt
+		b.LentAt = &lentAt
+	}
+	if b.EstimatedHours != nil {
+		hours := *b.EstimatedHours
+		b.EstimatedHours = &hours
+	}
+	return b
+}
+
+// cloneStrings copies s, keeping nil and empty apart as they encode differently.
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(s)), s...)
+}
+
+func cloneInt(p *int) *int {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func cloneObjectID(p *primitive.ObjectID) *primitive.ObjectID {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
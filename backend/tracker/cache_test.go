@@ -0,0 +1,162 @@
+package tracker
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBookCacheCopies(t *testing.T) {
+	rating := 4
+	book := Book{
+		ID:      primitive.NewObjectID(),
+		Authors: []string{"Ursula K. Le Guin"},
+		Notes:   []primitive.ObjectID{primitive.NewObjectID()},
+		Tags:    []string{"scifi"},
+		Rating:  &rating,
+	}
+
+	tests := []struct {
+		name   string
+		change func(b *Book)
+	}{
+		{"append note", func(b *Book) { b.Notes = append(b.Notes[:1], primitive.NewObjectID()) }},
+		{"overwrite note", func(b *Book) { b.Notes[0] = primitive.NewObjectID() }},
+		{"overwrite tag", func(b *Book) { b.Tags[0] = "fantasy" }},
+		{"overwrite author", func(b *Book) { b.Authors[0] = "someone else" }},
+		{"change rating", func(b *Book) { *b.Rating = 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newBookCache(time.Minute, 10)
+			stored := book.clone()
+			cache.set(stored, cache.current())
+
+			// neither the copy stored nor a copy read may reach the cache
+			tt.change(&stored)
+			read, _ := cache.get(book.ID)
+			tt.change(&read)
+
+			got, ok := cache.get(book.ID)
+			if !ok {
+				t.Fatal("book not cached")
+			}
+			if got.Notes[0] != book.Notes[0] || len(got.Notes) != 1 || got.Tags[0] != "scifi" ||
+				got.Authors[0] != "Ursula K. Le Guin" || *got.Rating != 4 {
+				t.Errorf("cached book changed to %+v", got)
+			}
+		})
+	}
+}
+
+func TestBookCacheExpires(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		size   int
+		cached bool
+	}{
+		{"within ttl", time.Minute, 10, true},
+		{"expired", time.Nanosecond, 10, false},
+		{"disabled", time.Minute, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newBookCache(tt.ttl, tt.size)
+			book := Book{ID: primitive.NewObjectID()}
+			cache.set(book, cache.current())
+			time.Sleep(time.Millisecond)
+			if _, ok := cache.get(book.ID); ok != tt.cached {
+				t.Errorf("cached = %v, want %v", ok, tt.cached)
+			}
+		})
+	}
+}
+
+func TestBookCacheSkipsStaleReads(t *testing.T) {
+	book := Book{ID: primitive.NewObjectID(), Title: "read before the edit"}
+	tests := []struct {
+		name        string
+		invalidated []primitive.ObjectID
+		cached      bool
+	}{
+		{"no edit meanwhile", nil, true},
+		{"book edited meanwhile", []primitive.ObjectID{book.ID}, false},
+		// a coarse generation, any invalidation counts
+		{"other book edited meanwhile", []primitive.ObjectID{primitive.NewObjectID()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newBookCache(time.Minute, 10)
+			generation := cache.current()
+			for _, id := range tt.invalidated {
+				cache.invalidate(id)
+			}
+			cache.set(book, generation)
+			if _, ok := cache.get(book.ID); ok != tt.cached {
+				t.Errorf("cached = %v, want %v", ok, tt.cached)
+			}
+			// a book read after the invalidation is cached
+			cache.set(book, cache.current())
+			if _, ok := cache.get(book.ID); !ok {
+				t.Error("book read after the invalidation not cached")
+			}
+		})
+	}
+}
+
+func TestServicesHaveTheirOwnCache(t *testing.T) {
+	previous, previousCache := database, bookCache
+	t.Cleanup(func() { database, bookCache = previous, previousCache })
+	first := NewService(&Database{URI: "mongodb://127.0.0.1:1"})
+	second := NewService(&Database{URI: "mongodb://127.0.0.1:1"})
+	if first.books == second.books {
+		t.Fatal("two Services share a book cache")
+	}
+	if bookCache != second.books {
+		t.Error("getBook doesn't use the cache of the latest Service")
+	}
+}
+
+func TestGetBookServedFromCache(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"The Dispossessed"}})
+
+	finds := func() uint64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		if hist := metrics.mongoLatency["find"]; hist != nil {
+			return hist.count
+		}
+		return 0
+	}
+
+	path := "/book/" + book.ID.Hex()
+	if w, _ := send(t, h, "GET", path, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("first GET: %d %s", w.Code, w.Body.String())
+	}
+	before := finds()
+	w, resp := send(t, h, "GET", path, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("second GET: %d %s", w.Code, w.Body.String())
+	}
+	if after := finds(); after != before {
+		t.Errorf("second GET sent %d find commands, want none", after-before)
+	}
+	var got Book
+	decode(t, resp, &got)
+	if got.Title != "The Dispossessed" {
+		t.Errorf("title = %q", got.Title)
+	}
+
+	// an edit invalidates the cached copy
+	send(t, h, "PATCH", path, url.Values{"title": {"The Dispossessed: An Ambiguous Utopia"}}, nil)
+	_, resp = send(t, h, "GET", path, nil, nil)
+	decode(t, resp, &got)
+	if got.Title != "The Dispossessed: An Ambiguous Utopia" {
+		t.Errorf("title after edit = %q", got.Title)
+	}
+}
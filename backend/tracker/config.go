@@ -0,0 +1,74 @@
+package tracker
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envString reads a setting from the environment, or fallback when unset.
+func envString(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envList reads a comma separated setting, dropping empty items.
+func envList(key string, fallback []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envInt reads an integer setting from the environment, falling back to the
+// given default when the variable is unset or malformed.
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logErrorf("invalid %s=%q, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// envDuration is envInt for time.ParseDuration values such as "30s".
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logErrorf("invalid %s=%q, using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// envBool reads a true/false setting such as "1", "true" or "false".
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logErrorf("invalid %s=%q, using %t", key, v, fallback)
+		return fallback
+	}
+	return b
+}
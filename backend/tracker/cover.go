@@ -0,0 +1,146 @@
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Covers are at most TRACKER_MAX_COVER_BYTES, 2 MiB by default
+var maxCoverBytes = envInt("TRACKER_MAX_COVER_BYTES", 2<<20)
+
+var errNoCover = errors.New("the book has no cover")
+
+// coverURL is where GET serves the cover of the book.
+func coverURL(bookID primitive.ObjectID) string {
+	return fmt.Sprintf("/book/%s/cover", bookID.Hex())
+}
+
+// coverBucket is the GridFS bucket holding the covers. Its operations take
+// deadlines rather than contexts, see boundCover.
+func coverBucket() (*gridfs.Bucket, error) {
+	client, err := database.connect()
+	if err != nil {
+		return nil, err
+	}
+	return gridfs.NewBucket(client.Database(database.Name), options.GridFSBucket().SetName(database.CoverBucket))
+}
+
+// boundCover bounds the next operation on bucket like every other operation,
+// so it's called right before each one.
+func boundCover(bucket *gridfs.Bucket) error {
+	deadline := time.Now().Add(connectTimeout * time.Second)
+	if err := bucket.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return bucket.SetReadDeadline(deadline)
+}
+
+// deleteCover deletes the cover file, once nothing refers to it anymore.
+func deleteCover(fileID primitive.ObjectID) {
+	bucket, err := coverBucket()
+	if err == nil {
+		err = boundCover(bucket)
+	}
+	if err == nil {
+		err = bucket.Delete(fileID)
+	}
+	if err != nil && err != gridfs.ErrFileNotFound {
+		logErrorf("Could not delete cover %s: %v", fileID.Hex(), err)
+	}
+}
+
+// setCover stores the image as the cover of the book, replacing the previous
+// one. It returns mongo.ErrNoDocuments if the book doesn't exist.
+func setCover(bookID primitive.ObjectID, image []byte, contentType string) error {
+	bucket, err := coverBucket()
+	if err != nil {
+		logErrorf("%v", err)
+		return err
+	}
+
+	fileID := primitive.NewObjectID()
+	if err := boundCover(bucket); err != nil {
+		return err
+	}
+	err = bucket.UploadFromStreamWithID(fileID, bookID.Hex(), bytes.NewReader(image),
+		options.GridFSUpload().SetMetadata(bson.M{"contentType": contentType, "bookid": bookID}))
+	if err != nil {
+		logErrorf("Could not upload the cover of Book %s: %v", bookID.Hex(), err)
+		return err
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	// the previous cover is only dropped once the book points to the new one
+	var previous Book
+	err = collection.FindOneAndUpdate(ctx, bson.M{"id": bookID}, bson.M{
+		"$set": bson.M{"coverid": fileID, "updatedat": time.Now()},
+	}).Decode(&previous)
+	bookCache.invalidate(bookID)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logErrorf("%v", err)
+		}
+		deleteCover(fileID)
+		return err
+	}
+	if previous.CoverID != nil {
+		deleteCover(*previous.CoverID)
+	}
+	return nil
+}
+
+// openCover opens the cover of the book for reading, with its content type.
+// The caller closes the stream.
+func openCover(bookID primitive.ObjectID) (*gridfs.DownloadStream, string, error) {
+	book, err := getBook(bookID)
+	if err != nil {
+		return nil, "", err
+	}
+	if book.ID.IsZero() {
+		return nil, "", mongo.ErrNoDocuments
+	}
+	if book.CoverID == nil {
+		return nil, "", errNoCover
+	}
+
+	bucket, err := coverBucket()
+	if err != nil {
+		logErrorf("%v", err)
+		return nil, "", err
+	}
+	// the deadline also bounds reading the stream
+	if err := boundCover(bucket); err != nil {
+		return nil, "", err
+	}
+	stream, err := bucket.OpenDownloadStream(*book.CoverID)
+	if err == gridfs.ErrFileNotFound {
+		return nil, "", errNoCover
+	}
+	if err != nil {
+		logErrorf("Could not open the cover of Book %s: %v", bookID.Hex(), err)
+		return nil, "", err
+	}
+
+	contentType := "application/octet-stream"
+	if file := stream.GetFile(); file.Metadata != nil {
+		if v, ok := file.Metadata.Lookup("contentType").StringValueOK(); ok {
+			contentType = v
+		}
+	}
+	return stream, contentType, nil
+}
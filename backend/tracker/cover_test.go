@@ -0,0 +1,99 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// coverStored tells whether the cover file is still in the bucket.
+func coverStored(t *testing.T, fileID primitive.ObjectID) bool {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	files := testClient(t).Database(database.Name).Collection(database.CoverBucket + ".files")
+	n, err := files.CountDocuments(ctx, bson.M{"_id": fileID})
+	if err != nil {
+		t.Fatalf("counting cover files: %v", err)
+	}
+	return n > 0
+}
+
+// addTestCover adds a book with a cover, returning the book as stored.
+func addTestCover(t *testing.T, h http.Handler) Book {
+	t.Helper()
+	book := addTestBook(t, h, url.Values{"title": {"Covered"}})
+	if err := setCover(book.ID, []byte("\x89PNG\r\n\x1a\n"), "image/png"); err != nil {
+		t.Fatalf("setting the cover: %v", err)
+	}
+	// the cover id isn't part of the API
+	book, err := getBook(book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.CoverID == nil || !coverStored(t, *book.CoverID) {
+		t.Fatal("the cover wasn't stored")
+	}
+	return book
+}
+
+// deleteTestBook deletes the book through the API.
+func deleteTestBook(t *testing.T, h http.Handler, id primitive.ObjectID) {
+	t.Helper()
+	if w, _ := sendMultipart(t, h, "DELETE", "/book", url.Values{"id": {id.Hex()}}); w.Code != http.StatusOK {
+		t.Fatalf("DELETE /book: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteBookCover(t *testing.T) {
+	h := newTestService(t)
+	tests := []struct {
+		name      string
+		undo      *undoStack
+		after     func(t *testing.T)
+		wantCover bool
+	}{
+		{"kept while the deletion can be undone", newUndoBuffer(10, time.Hour), nil, true},
+		{"deleted without undo", newUndoBuffer(0, time.Hour), nil, false},
+		{"deleted once the deletion expires", newUndoBuffer(10, time.Millisecond), func(t *testing.T) {
+			time.Sleep(5 * time.Millisecond)
+			undoBuffer.pop()
+		}, false},
+		{"deleted once the deletion is pushed out", newUndoBuffer(1, time.Hour), func(t *testing.T) {
+			deleteTestBook(t, h, addTestBook(t, h, url.Values{"title": {"Next"}}).ID)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			undoBuffer = tt.undo
+			book := addTestCover(t, h)
+			deleteTestBook(t, h, book.ID)
+			if tt.after != nil {
+				tt.after(t)
+			}
+			if got := coverStored(t, *book.CoverID); got != tt.wantCover {
+				t.Errorf("cover stored = %v, want %v", got, tt.wantCover)
+			}
+		})
+	}
+}
+
+func TestSetCoverReplaces(t *testing.T) {
+	h := newTestService(t)
+	book := addTestCover(t, h)
+	if err := setCover(book.ID, []byte("\x89PNG\r\n\x1a\n"), "image/png"); err != nil {
+		t.Fatalf("replacing the cover: %v", err)
+	}
+	if coverStored(t, *book.CoverID) {
+		t.Error("the previous cover is still stored")
+	}
+	replaced, _ := getBook(book.ID)
+	if replaced.CoverID == nil || !coverStored(t, *replaced.CoverID) {
+		t.Error("the new cover isn't stored")
+	}
+}
@@ -2,10 +2,12 @@ package tracker
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -14,39 +16,147 @@ const (
 	// Timeout operations after N seconds
 	connectTimeout           = 5
 	connectionStringTemplate = "mongodb://%s:%s@%s"
+	devURI                   = "mongodb://localhost:27017/?readPreference=primary&appname=MongoDB%20Compass&ssl=false"
 )
 
-// GetConnection - Retrieves a client to the DocumentDB
-func getConnection() (*mongo.Client, context.Context, context.CancelFunc) {
-	// username := os.Getenv("MONGODB_USERNAME")
-	// password := os.Getenv("MONGODB_PASSWORD")
-	// clusterEndpoint := os.Getenv("MONGODB_ENDPOINT")
-	// username := "root"
-	// password := "toor"
-	// clusterEndpoint := "localhost:27010"
+// Database owns the MongoDB client shared by every request, and names the
+// database and collections it works on.
+type Database struct {
+	URI            string
+	Name           string
+	BookCollection string
+	NoteCollection string
+	GoalCollection string
+	// GridFS bucket of the book covers
+	CoverBucket string
 
-	// connectionURI := fmt.Sprintf(connectionStringTemplate, username, password, clusterEndpoint)
+	// client settings, zero keeps the driver default
+	MaxPoolSize            uint64
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
 
-	devURI := "mongodb://localhost:27017/?readPreference=primary&appname=MongoDB%20Compass&ssl=false"
-	// client, err := mongo.NewClient(options.Client().ApplyURI(connectionURI))
-	client, err := mongo.NewClient(options.Client().ApplyURI(devURI))
-	if err != nil {
-		log.Printf("Failed to create client: %v", err)
+	once   sync.Once
+	client *mongo.Client
+	// why the client couldn't be set up, returned by every later connect
+	err error
+}
+
+// errNoDatabase is answered, as a 500, while the client can't be set up. The
+// cause is only logged, it may hold the connection string.
+var errNoDatabase = errors.New("the database is unavailable")
+
+// Every setting can be overridden from the environment, e.g. to run against
+// isolated collections. The pool allows 100 connections, as the driver does;
+// raise it when requests queue for a connection under load. A server that
+// can't be reached fails requests after 5s rather than the driver's 30s.
+var database = &Database{
+	URI:            envString("TRACKER_MONGO_URI", devURI),
+	Name:           envString("TRACKER_DB_NAME", "tracker"),
+	BookCollection: envString("TRACKER_BOOK_COLLECTION", "book"),
+	NoteCollection: envString("TRACKER_NOTE_COLLECTION", "note"),
+	GoalCollection: envString("TRACKER_GOAL_COLLECTION", "goal"),
+	CoverBucket:    envString("TRACKER_COVER_BUCKET", "cover"),
+
+	MaxPoolSize:            uint64(envInt("TRACKER_MONGO_MAX_POOL_SIZE", 100)),
+	ConnectTimeout:         envDuration("TRACKER_MONGO_CONNECT_TIMEOUT", connectTimeout*time.Second),
+	ServerSelectionTimeout: envDuration("TRACKER_MONGO_SERVER_SELECTION_TIMEOUT", connectTimeout*time.Second),
+}
+
+// clientOptions turns the settings into driver options.
+func (d *Database) clientOptions() *options.ClientOptions {
+	opts := options.Client().ApplyURI(d.URI).SetMonitor(mongoMonitor())
+	if d.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(d.MaxPoolSize)
+	}
+	if d.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(d.ConnectTimeout)
+	}
+	if d.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(d.ServerSelectionTimeout)
 	}
+	return opts
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout*time.Second)
+// connect lazily creates the client on first use. If that fails, the error
+// is kept and returned from then on, wrapping errNoDatabase.
+func (d *Database) connect() (*mongo.Client, error) {
+	d.once.Do(func() {
+		// username := os.Getenv("MONGODB_USERNAME")
+		// password := os.Getenv("MONGODB_PASSWORD")
+		// clusterEndpoint := os.Getenv("MONGODB_ENDPOINT")
+		// connectionURI := fmt.Sprintf(connectionStringTemplate, username, password, clusterEndpoint)
+		client, err := mongo.NewClient(d.clientOptions())
+		if err != nil {
+			logErrorf("Failed to create client: %v", err)
+			d.err = fmt.Errorf("%w: %v", errNoDatabase, err)
+			return
+		}
 
-	err = client.Connect(ctx)
-	if err != nil {
-		log.Printf("Failed to connect to cluster: %v", err)
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout*time.Second)
+		defer cancel()
+
+		err = client.Connect(ctx)
+		if err != nil {
+			logErrorf("Failed to connect to cluster: %v", err)
+			d.err = fmt.Errorf("%w: %v", errNoDatabase, err)
+			return
+		}
+
+		// Force a connection to verify our connection string. The client
+		// keeps trying to reach the server, a failed ping is only logged.
+		err = client.Ping(ctx, nil)
+		if err != nil {
+			logErrorf("Failed to ping cluster: %v", err)
+		}
+
+		logDebugf("connected to MongoDB")
+		d.client = client
+		d.ensureIndexes(ctx)
+	})
+	return d.client, d.err
+}
+
+// Close disconnects the client, waiting for in-flight operations until ctx expires.
+func (d *Database) Close(ctx context.Context) error {
+	if d.client == nil {
+		return nil
 	}
+	return d.client.Disconnect(ctx)
+}
 
-	// Force a connection to verify our connection string
-	err = client.Ping(ctx, nil)
+// GetConnection - Retrieves the shared client and a context bounding one
+// operation, or why there is no client.
+func getConnection() (*mongo.Client, context.Context, context.CancelFunc, error) {
+	client, err := database.connect()
 	if err != nil {
-		log.Printf("Failed to ping cluster: %v", err)
+		return nil, nil, nil, err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout*time.Second)
+	return client, ctx, cancel, nil
+}
 
-	fmt.Println("Connected to MongoDB!")
-	return client, ctx, cancel
+// ensureIndexes creates the indexes the tracker relies on, once per process.
+// Creating an index that already exists is a no-op.
+func (d *Database) ensureIndexes(ctx context.Context) {
+	books := d.client.Database(d.Name).Collection(d.BookCollection)
+	// books without an ISBN don't collide
+	_, err := books.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "isbn", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"isbn": bson.M{"$gt": ""}}),
+	})
+	if err != nil {
+		logErrorf("Failed to create the isbn index: %v", err)
+	}
+	// books added before slugs existed don't have one
+	_, err = books.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"slug": bson.M{"$gt": ""}}),
+	})
+	if err != nil {
+		logErrorf("Failed to create the slug index: %v", err)
+	}
 }
@@ -0,0 +1,50 @@
+package tracker
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDatabaseUnavailable(t *testing.T) {
+	// a connection string the driver can't even parse
+	db := &Database{URI: "not-a-uri", Name: "tracker_test", BookCollection: "book", NoteCollection: "note"}
+	h := newTestServiceOn(t, db)
+	id := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+	}{
+		{"get book", "GET", "/book/" + id, nil},
+		{"list books", "GET", "/book", nil},
+		{"add book", "POST", "/book", url.Values{"title": {"Unsaved"}}},
+		{"edit book", "PATCH", "/book/" + id, url.Values{"title": {"Unsaved"}}},
+		{"get note", "GET", "/note/" + id, nil},
+		{"edit note", "PATCH", "/note/" + id, url.Values{"content": {"unsaved"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, tt.method, tt.target, tt.form, nil)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("%s %s: %d, want %d: %s", tt.method, tt.target, w.Code, http.StatusInternalServerError, w.Body.String())
+			}
+			// errInternal would mean the handler panicked
+			if resp.Error != errNoDatabase.Error() {
+				t.Errorf("error = %q, want %q", resp.Error, errNoDatabase)
+			}
+		})
+	}
+
+	// the error is kept, not a nil client
+	for i := 0; i < 2; i++ {
+		if client, err := db.connect(); client != nil || !errors.Is(err, errNoDatabase) {
+			t.Errorf("connect = %v, %v, want errNoDatabase", client, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tracker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// exportFilename derives an attachment name from the book title.
+func exportFilename(book Book) string {
+	name := strings.Trim(unsafeFilename.ReplaceAllString(book.Title, "-"), "-")
+	if name == "" {
+		name = book.ID.Hex()
+	}
+	return strings.ToLower(name) + ".md"
+}
+
+// bookMarkdown renders the book and its notes as a Markdown document, replies
+// nested under the note they answer.
+func bookMarkdown(book Book, notes []Note) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", book.Title)
+	if len(book.Authors) > 0 {
+		fmt.Fprintf(&b, "- **Author:** %s\n", strings.Join(book.Authors, ", "))
+	}
+	fmt.Fprintf(&b, "- **Status:** %s\n", statusName(book.Status))
+	if book.Series != "" {
+		fmt.Fprintf(&b, "- **Series:** %s #%d\n", book.Series, book.SeriesOrder)
+	}
+	if !book.StartTime.IsZero() {
+		fmt.Fprintf(&b, "- **Started:** %s\n", book.StartTime.Format("2006-01-02"))
+	}
+	if !book.EndTime.IsZero() {
+		fmt.Fprintf(&b, "- **Finished:** %s\n", book.EndTime.Format("2006-01-02"))
+	}
+	if book.Description != "" {
+		fmt.Fprintf(&b, "\n%s\n", book.Description)
+	}
+
+	if len(notes) == 0 {
+		return b.String()
+	}
+	b.WriteString("\n## Notes\n\n")
+
+	byID := make(map[primitive.ObjectID]bool, len(notes))
+	for _, note := range notes {
+		byID[note.ID] = true
+	}
+	// replies to a note that isn't part of the export become roots
+	replies := make(map[primitive.ObjectID][]Note)
+	var roots []Note
+	for _, note := range notes {
+		if !note.ReplyTo.IsZero() && byID[note.ReplyTo] {
+			replies[note.ReplyTo] = append(replies[note.ReplyTo], note)
+		} else {
+			roots = append(roots, note)
+		}
+	}
+
+	visited := make(map[primitive.ObjectID]bool, len(notes))
+	var write func(notes []Note, depth int)
+	write = func(notes []Note, depth int) {
+		sort.SliceStable(notes, func(i, j int) bool {
+			return notes[i].CreateTime.Before(notes[j].CreateTime)
+		})
+		for _, note := range notes {
+			if visited[note.ID] {
+				continue
+			}
+			visited[note.ID] = true
+
+			indent := strings.Repeat("  ", depth)
+			// continuation lines stay inside the bullet
+			content := strings.ReplaceAll(strings.TrimSpace(note.Content), "\n", "\n"+indent+"  ")
+			if note.Page > 0 {
+				content += fmt.Sprintf(" (p. %d)", note.Page)
+			}
+			fmt.Fprintf(&b, "%s- %s\n", indent, content)
+			write(replies[note.ID], depth+1)
+		}
+	}
+	write(roots, 0)
+	// notes replying to one another in a cycle have no root, each cycle is
+	// written from its oldest note
+	var unreached []Note
+	for _, note := range notes {
+		if !visited[note.ID] {
+			unreached = append(unreached, note)
+		}
+	}
+	write(unreached, 0)
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package tracker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBookMarkdownWritesEveryNote(t *testing.T) {
+	book := Book{ID: primitive.NewObjectID(), Title: "Threads"}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// notes returns n notes of the book, created a minute apart
+	notes := func(n int) []Note {
+		list := make([]Note, n)
+		for i := range list {
+			list[i] = Note{
+				ID:         primitive.NewObjectID(),
+				BookID:     book.ID,
+				Content:    string(rune('a' + i)),
+				CreateTime: start.Add(time.Duration(i) * time.Minute),
+			}
+		}
+		return list
+	}
+
+	tests := []struct {
+		name  string
+		notes func() []Note
+		want  string
+	}{
+		{"reply", func() []Note {
+			n := notes(2)
+			n[1].ReplyTo = n[0].ID
+			return n
+		}, "- a\n  - b\n"},
+		{"two-note cycle", func() []Note {
+			n := notes(2)
+			n[0].ReplyTo, n[1].ReplyTo = n[1].ID, n[0].ID
+			return n
+		}, "- a\n  - b\n"},
+		{"cycle beside a root", func() []Note {
+			n := notes(3)
+			n[1].ReplyTo, n[2].ReplyTo = n[2].ID, n[1].ID
+			return n
+		}, "- a\n- b\n  - c\n"},
+		{"reply to a note of another book", func() []Note {
+			n := notes(2)
+			n[0].ReplyTo = primitive.NewObjectID()
+			n[1].ReplyTo = n[0].ID
+			return n
+		}, "- a\n  - b\n"},
+		{"reply to itself", func() []Note {
+			n := notes(1)
+			n[0].ReplyTo = n[0].ID
+			return n
+		}, "- a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := bookMarkdown(book, tt.notes())
+			got := md[strings.Index(md, "## Notes\n\n")+len("## Notes\n\n"):]
+			if got != tt.want {
+				t.Errorf("notes written as\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package tracker
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How a query param filters its field
+type filterKind int
+
+const (
+	// the field equals the value, or any of the fields for several keys
+	filterExact filterKind = iota
+	// the field contains the value, ignoring case
+	filterRegex
+	// the field equals one of the comma separated values
+	filterIn
+	// the field is bounded by the value, see fieldSpec.Op
+	filterRange
+)
+
+// fieldSpec describes the filter a query param adds.
+type fieldSpec struct {
+	// bson keys of the field, exact matches accept any of them
+	Keys []string
+	Kind filterKind
+	// comparison operator of a range, e.g. "$gte"
+	Op string
+	// turns the param into the value compared, the string as is when nil
+	Parse func(string) (interface{}, error)
+}
+
+// buildFilter turns the query params listed in specs into a filter, values
+// always taken literally. Params on the same key, e.g. two bounds of a range,
+// are merged. Conditions repeating a key are combined with $and.
+func buildFilter(specs map[string]fieldSpec, query url.Values) (bson.D, error) {
+	// sorted for a stable filter, which keeps logs and query plans readable
+	params := make([]string, 0, len(specs))
+	for param := range specs {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	var conditions []bson.E
+	// index in conditions of the range on each key
+	ranges := map[string]int{}
+	for _, param := range params {
+		raw := strings.TrimSpace(query.Get(param))
+		if raw == "" {
+			continue
+		}
+		spec := specs[param]
+		parse := spec.Parse
+		if parse == nil {
+			parse = asString
+		}
+
+		switch spec.Kind {
+		case filterExact:
+			value, err := parse(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", param, err)
+			}
+			if len(spec.Keys) == 1 {
+				conditions = append(conditions, eqLiteral(spec.Keys[0], value))
+				break
+			}
+			anyOf := bson.A{}
+			for _, key := range spec.Keys {
+				anyOf = append(anyOf, bson.D{eqLiteral(key, value)})
+			}
+			conditions = append(conditions, bson.E{Key: "$or", Value: anyOf})
+		case filterRegex:
+			conditions = append(conditions, bson.E{Key: spec.Keys[0], Value: primitive.Regex{
+				Pattern: regexp.QuoteMeta(raw),
+				Options: "i",
+			}})
+		case filterIn:
+			values := bson.A{}
+			for _, part := range strings.Split(raw, ",") {
+				value, err := parse(strings.TrimSpace(part))
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", param, err)
+				}
+				values = append(values, value)
+			}
+			conditions = append(conditions, bson.E{Key: spec.Keys[0], Value: bson.M{"$in": values}})
+		case filterRange:
+			value, err := parse(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", param, err)
+			}
+			key := spec.Keys[0]
+			i, ok := ranges[key]
+			if !ok {
+				i = len(conditions)
+				ranges[key] = i
+				conditions = append(conditions, bson.E{Key: key, Value: bson.M{}})
+			}
+			conditions[i].Value.(bson.M)[spec.Op] = value
+		}
+	}
+	return andFilter(conditions...), nil
+}
+
+// andFilter combines conditions into one filter, with $and when a key repeats
+// since a document can't hold the same key twice.
+func andFilter(conditions ...bson.E) bson.D {
+	seen := map[string]bool{}
+	repeated := false
+	for _, cond := range conditions {
+		repeated = repeated || seen[cond.Key]
+		seen[cond.Key] = true
+	}
+	if !repeated {
+		return bson.D(conditions)
+	}
+	all := bson.A{}
+	for _, cond := range conditions {
+		all = append(all, bson.D{cond})
+	}
+	return bson.D{{Key: "$and", Value: all}}
+}
+
+func asString(s string) (interface{}, error) {
+	return s, nil
+}
+
+func asObjectID(s string) (interface{}, error) {
+	return primitive.ObjectIDFromHex(s)
+}
+
+func asTime(s string) (interface{}, error) {
+	t, err := time.Parse(layoutISO, s)
+	if err != nil {
+		return nil, fmt.Errorf("must look like %q", layoutISO)
+	}
+	return t, nil
+}
+
+func asStatus(s string) (interface{}, error) {
+	return parseStatus(s)
+}
+
+func asRating(s string) (interface{}, error) {
+	rating, err := parseRating(s)
+	if err != nil {
+		return nil, err
+	}
+	return *rating, nil
+}
+
+func asColor(s string) (interface{}, error) {
+	return parseColor(s)
+}
+
+func asNoteType(s string) (interface{}, error) {
+	return parseNoteType(s)
+}
+
+// bookFilters are the ListBook query params filtering directly on a field.
+var bookFilters = map[string]fieldSpec{
+	"id":        {Keys: []string{"id"}, Parse: asObjectID},
+	"title":     {Keys: []string{"title"}},
+	"startTime": {Keys: []string{"starttime"}, Parse: asTime},
+	"endTime":   {Keys: []string{"endtime"}, Parse: asTime},
+	// author matches any of the book's authors
+	"author":      {Keys: []string{"author", "authors"}},
+	"description": {Keys: []string{"description"}, Kind: filterRegex},
+	// status=reading or status=reading,finished
+	"status": {Keys: []string{"status"}, Kind: filterIn, Parse: asStatus},
+	// finishedAfter/finishedBefore bound endTime, both in layoutISO
+	"finishedAfter":  {Keys: []string{"endtime"}, Kind: filterRange, Op: "$gte", Parse: asTime},
+	"finishedBefore": {Keys: []string{"endtime"}, Kind: filterRange, Op: "$lte", Parse: asTime},
+	"minRating":      {Keys: []string{"rating"}, Kind: filterRange, Op: "$gte", Parse: asRating},
+	"maxRating":      {Keys: []string{"rating"}, Kind: filterRange, Op: "$lte", Parse: asRating},
+}
+
+// noteFilters are the note feed query params filtering directly on a field.
+var noteFilters = map[string]fieldSpec{
+	"bookid": {Keys: []string{"bookid"}, Parse: asObjectID},
+	"color":  {Keys: []string{"color"}, Parse: asColor},
+	"type":   {Keys: []string{"type"}, Parse: asNoteType},
+}
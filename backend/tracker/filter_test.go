@@ -0,0 +1,83 @@
+package tracker
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBuildFilterLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   url.Values
+		want    bson.D
+		wantErr bool
+	}{
+		{"operator as a value", url.Values{"title": {`{"$gt":""}`}},
+			bson.D{eqLiteral("title", `{"$gt":""}`)}, false},
+		{"operator name as a value", url.Values{"title": {"$ne"}}, bson.D{eqLiteral("title", "$ne")}, false},
+		{"operator in any of several keys", url.Values{"author": {`{"$ne":null}`}},
+			bson.D{{Key: "$or", Value: bson.A{
+				bson.D{eqLiteral("author", `{"$ne":null}`)},
+				bson.D{eqLiteral("authors", `{"$ne":null}`)},
+			}}}, false},
+		{"regex metacharacters", url.Values{"description": {".*"}},
+			bson.D{{Key: "description", Value: primitive.Regex{Pattern: `\.\*`, Options: "i"}}}, false},
+		{"operator in the param name", url.Values{"title[$ne]": {"x"}, "$where": {"1"}}, bson.D{}, false},
+		{"operator where a status goes", url.Values{"status": {`{"$gt":0}`}}, nil, true},
+		{"operator where an id goes", url.Values{"id": {`{"$ne":""}`}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildFilter(bookFilters, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildFilter error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) && !(len(got) == 0 && len(tt.want) == 0) {
+				t.Errorf("buildFilter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListBookInjection(t *testing.T) {
+	h := newTestService(t)
+	plain := addTestBook(t, h, url.Values{"title": {"Plain"}})
+	literal := addTestBook(t, h, url.Values{"title": {`{"$gt":""}`}})
+
+	tests := []struct {
+		name  string
+		query string
+		want  []primitive.ObjectID
+	}{
+		{"operator matches only the literal title", "?title=" + url.QueryEscape(`{"$gt":""}`), []primitive.ObjectID{literal.ID}},
+		{"operator matches no other title", "?title=" + url.QueryEscape(`{"$ne":"x"}`), nil},
+		{"operator in the param name is ignored", "?title[$ne]=x", []primitive.ObjectID{plain.ID, literal.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, "GET", "/book"+tt.query, nil, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /book%s: %d %s", tt.query, w.Code, w.Body.String())
+			}
+			var books []Book
+			decode(t, resp, &books)
+			got := map[primitive.ObjectID]bool{}
+			for _, book := range books {
+				got[book.ID] = true
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d books, want %d", len(got), len(tt.want))
+			}
+			for _, id := range tt.want {
+				if !got[id] {
+					t.Errorf("book %s missing", id.Hex())
+				}
+			}
+		})
+	}
+}
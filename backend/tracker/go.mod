@@ -5,6 +5,7 @@ go 1.15
 require (
 	github.com/gin-contrib/sessions v0.0.3
 	github.com/gin-gonic/contrib v0.0.0-20201005132743-ca038bbf2944
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-gonic/gin v1.7.7
+	github.com/yuin/goldmark v1.4.13
 	go.mongodb.org/mongo-driver v1.4.1
 )
@@ -0,0 +1,68 @@
+package tracker
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// setGoal creates or replaces the reading goal of goal.Year.
+func setGoal(goal Goal) error {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.GoalCollection)
+
+	_, err = collection.UpdateOne(
+		ctx,
+		bson.M{"year": goal.Year},
+		bson.M{"$set": bson.M{"target": goal.Target}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		logErrorf("Could not set Goal: %v", err)
+		return err
+	}
+	return nil
+}
+
+// getGoal returns the goal of year, or mongo.ErrNoDocuments if none was set.
+func getGoal(year int) (goal Goal, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return goal, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.GoalCollection)
+
+	err = collection.FindOne(ctx, bson.M{"year": year}).Decode(&goal)
+	return goal, err
+}
+
+// countFinished counts the books finished during year, in loc.
+func countFinished(year int, loc *time.Location) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	filter := bson.M{
+		"status":  StatusFinished,
+		"endtime": bson.M{"$gte": start, "$lt": start.AddDate(1, 0, 0)},
+	}
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	return int(count), nil
+}
@@ -0,0 +1,93 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Gzip compresses responses for clients sending Accept-Encoding: gzip.
+// Bodies shorter than minSize bytes are sent as is, compressing them costs
+// more than it saves.
+func Gzip(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") || c.Request.Method == "HEAD" {
+			c.Next()
+			return
+		}
+
+		w := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = w
+		defer func() {
+			w.finish()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// gzipWriter holds the body back until it reaches minSize, then switches to
+// compressing it.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	buf     []byte
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) < w.minSize {
+		return len(b), nil
+	}
+	// a handler encoding its own body is left alone
+	if w.Header().Get("Content-Encoding") != "" {
+		if err := w.flushRaw(); err != nil {
+			return 0, err
+		}
+		w.minSize = 0
+		return len(b), nil
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	buf := w.buf
+	w.buf = nil
+	if _, err := w.gz.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) flushRaw() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// finish sends what is left of the body.
+func (w *gzipWriter) finish() {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			logErrorf("gzip: %v", err)
+		}
+		return
+	}
+	if err := w.flushRaw(); err != nil {
+		logErrorf("gzip: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGzip(t *testing.T) {
+	const minSize = 100
+	large := strings.Repeat("book ", minSize)
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		body           string
+		ownEncoding    string
+		wantGzip       bool
+	}{
+		{"large body", "GET", "gzip", large, "", true},
+		{"among other encodings", "GET", "deflate, gzip;q=0.8", large, "", true},
+		{"not accepted", "GET", "", large, "", false},
+		{"other encoding only", "GET", "br", large, "", false},
+		{"small body", "GET", "gzip", "book", "", false},
+		{"HEAD", "HEAD", "gzip", large, "", false},
+		{"already encoded", "GET", "gzip", large, "identity", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(Gzip(minSize))
+			router.Handle(tt.method, "/", func(c *gin.Context) {
+				if tt.ownEncoding != "" {
+					c.Header("Content-Encoding", tt.ownEncoding)
+				}
+				c.String(http.StatusOK, tt.body)
+			})
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			gzipped := w.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", w.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			if tt.method == "HEAD" {
+				return
+			}
+			body := w.Body.String()
+			if gzipped {
+				r, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("reading the gzip body: %v", err)
+				}
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatalf("reading the gzip body: %v", err)
+				}
+				body = string(b)
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
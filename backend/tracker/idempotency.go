@@ -0,0 +1,79 @@
+package tracker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still in progress")
+
+// Results of writes sent with an Idempotency-Key are remembered for
+// TRACKER_IDEMPOTENCY_TTL.
+var idempotencyKeys = &idempotencyStore{
+	ttl:     envDuration("TRACKER_IDEMPOTENCY_TTL", 24*time.Hour),
+	entries: make(map[string]idempotencyEntry),
+}
+
+type idempotencyEntry struct {
+	id      primitive.ObjectID
+	done    bool
+	expires time.Time
+}
+
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]idempotencyEntry
+}
+
+// idempotent runs create at most once per Idempotency-Key header and scope.
+// A retry with the same key gets the id created the first time. Requests
+// without the header always run create.
+func idempotent(c *gin.Context, scope string, create func() (primitive.ObjectID, error)) (primitive.ObjectID, error) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		return create()
+	}
+	key = scope + ":" + key
+
+	s := idempotencyKeys
+	s.mu.Lock()
+	s.sweep()
+	if entry, ok := s.entries[key]; ok {
+		s.mu.Unlock()
+		if !entry.done {
+			return primitive.NilObjectID, errIdempotencyInProgress
+		}
+		return entry.id, nil
+	}
+	s.entries[key] = idempotencyEntry{expires: time.Now().Add(s.ttl)}
+	s.mu.Unlock()
+
+	id, err := create()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// let the client retry a failed write with the same key
+		delete(s.entries, key)
+		return id, err
+	}
+	s.entries[key] = idempotencyEntry{id: id, done: true, expires: time.Now().Add(s.ttl)}
+	return id, nil
+}
+
+// sweep drops expired keys. Callers must hold s.mu.
+func (s *idempotencyStore) sweep() {
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
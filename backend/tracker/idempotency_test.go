@@ -0,0 +1,79 @@
+package tracker
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIdempotentInProgress(t *testing.T) {
+	h := newTestRouter(t)
+	tests := []struct {
+		name   string
+		target string
+		scope  string
+		form   url.Values
+	}{
+		{"AddBook", "/book", "book", url.Values{"title": {"Twice"}}},
+		{"AddNote", "/note", "note", url.Values{"bookID": {primitive.NewObjectID().Hex()}, "content": {"twice"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := primitive.NewObjectID().Hex()
+			idempotencyKeys.mu.Lock()
+			idempotencyKeys.entries[tt.scope+":"+key] = idempotencyEntry{expires: time.Now().Add(time.Minute)}
+			idempotencyKeys.mu.Unlock()
+
+			w, resp := send(t, h, "POST", tt.target, tt.form, http.Header{idempotencyKeyHeader: {key}})
+			if w.Code != http.StatusConflict {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusConflict, w.Body.String())
+			}
+			if resp.Error != errIdempotencyInProgress.Error() {
+				t.Errorf("error = %q, want %q", resp.Error, errIdempotencyInProgress)
+			}
+		})
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	errWrite := errors.New("write failed")
+	tests := []struct {
+		name    string
+		key     string
+		results []error
+		want    []primitive.ObjectID
+		wantErr []error
+	}{
+		{"no key", "", []error{nil, nil}, []primitive.ObjectID{first, second}, []error{nil, nil}},
+		{"same key", "k1", []error{nil, nil}, []primitive.ObjectID{first, first}, []error{nil, nil}},
+		{"retry after a failure", "k2", []error{errWrite, nil}, []primitive.ObjectID{first, second}, []error{errWrite, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			for i, result := range tt.results {
+				c, _ := gin.CreateTestContext(nil)
+				c.Request, _ = http.NewRequest("POST", "/", nil)
+				if tt.key != "" {
+					c.Request.Header.Set(idempotencyKeyHeader, t.Name()+tt.key)
+				}
+				id, err := idempotent(c, "test", func() (primitive.ObjectID, error) {
+					calls++
+					if calls == 1 {
+						return first, result
+					}
+					return second, result
+				})
+				if err != tt.wantErr[i] || (err == nil && id != tt.want[i]) {
+					t.Errorf("request %d = %s, %v, want %s, %v", i+1, id.Hex(), err, tt.want[i].Hex(), tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
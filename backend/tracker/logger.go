@@ -0,0 +1,50 @@
+package tracker
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"error": levelError,
+}
+
+// Log level is read from TRACKER_LOG_LEVEL (debug, info, error), default info.
+var currentLevel = parseLogLevel(os.Getenv("TRACKER_LOG_LEVEL"))
+
+func parseLogLevel(s string) logLevel {
+	if level, ok := logLevels[strings.ToLower(s)]; ok {
+		return level
+	}
+	return levelInfo
+}
+
+func logf(level logLevel, prefix string, format string, v ...interface{}) {
+	if level < currentLevel {
+		return
+	}
+	log.Printf(prefix+format, v...)
+}
+
+func logDebugf(format string, v ...interface{}) {
+	logf(levelDebug, "level=debug ", format, v...)
+}
+
+func logInfof(format string, v ...interface{}) {
+	logf(levelInfo, "level=info ", format, v...)
+}
+
+func logErrorf(format string, v ...interface{}) {
+	logf(levelError, "level=error ", format, v...)
+}
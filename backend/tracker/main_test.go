@@ -0,0 +1,204 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tests reaching MongoDB run against TRACKER_TEST_MONGO_URI, e.g.
+// mongodb://localhost:27017, and are skipped when it isn't set. Each test
+// gets collections of its own, dropped once it is done.
+const testMongoURIEnv = "TRACKER_TEST_MONGO_URI"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// tests send more writes than a client normally would
+	os.Setenv("TRACKER_WRITE_BURST", "100000")
+	os.Exit(m.Run())
+}
+
+// newTestRouter serves the API without a reachable database, for the
+// requests answered before any query.
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	return newTestServiceOn(t, &Database{
+		URI:                    "mongodb://127.0.0.1:1",
+		Name:                   "tracker_test",
+		BookCollection:         "book",
+		NoteCollection:         "note",
+		GoalCollection:         "goal",
+		CoverBucket:            "cover",
+		ServerSelectionTimeout: 100 * time.Millisecond,
+	})
+}
+
+// newTestService serves the API on scratch collections of the test server.
+func newTestService(t *testing.T) http.Handler {
+	t.Helper()
+	uri := os.Getenv(testMongoURIEnv)
+	if uri == "" {
+		t.Skip(testMongoURIEnv + " isn't set")
+	}
+	suffix := primitive.NewObjectID().Hex()
+	db := &Database{
+		URI:            uri,
+		Name:           "tracker_test",
+		BookCollection: "book_" + suffix,
+		NoteCollection: "note_" + suffix,
+		GoalCollection: "goal_" + suffix,
+		CoverBucket:    "cover_" + suffix,
+	}
+	h := newTestServiceOn(t, db)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if db.client == nil {
+			return
+		}
+		for _, name := range []string{db.BookCollection, db.NoteCollection, db.GoalCollection,
+			db.CoverBucket + ".files", db.CoverBucket + ".chunks"} {
+			_ = db.client.Database(db.Name).Collection(name).Drop(ctx)
+		}
+	})
+	return h
+}
+
+func newTestServiceOn(t *testing.T, db *Database) http.Handler {
+	previous := database
+	// every test starts without anything remembered by an earlier one, the
+	// Service brings a cache of its own
+	undoBuffer = newUndoBuffer(10, time.Hour)
+	s := NewService(db)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Close(ctx)
+		database = previous
+	})
+	return s.Handler()
+}
+
+// testClient is the client of the test's database, for checks the API can't do.
+func testClient(t *testing.T) *mongo.Client {
+	t.Helper()
+	client, err := database.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// testResponse is serverResponse with Data left to decode.
+type testResponse struct {
+	Success  bool
+	Data     json.RawMessage
+	Error    string
+	Warnings []string
+	Total    *int64
+	Errors   []FieldError
+}
+
+// send serves one request, the form being sent urlencoded.
+func send(t *testing.T, h http.Handler, method, target string, form url.Values, header http.Header) (*httptest.ResponseRecorder, testResponse) {
+	t.Helper()
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var resp testResponse
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, target, w.Body.String(), err)
+		}
+	}
+	return w, resp
+}
+
+// sendMultipart is send with the form sent as multipart, the only body
+// net/http reads for DELETE.
+func sendMultipart(t *testing.T, h http.Handler, method, target string, form url.Values) (*httptest.ResponseRecorder, testResponse) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for key, values := range form {
+		for _, value := range values {
+			if err := mw.WriteField(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var resp testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: decoding %q: %v", method, target, w.Body.String(), err)
+	}
+	return w, resp
+}
+
+// decode unmarshals the data of a response into v.
+func decode(t *testing.T, resp testResponse, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(resp.Data, v); err != nil {
+		t.Fatalf("decoding %s: %v", resp.Data, err)
+	}
+}
+
+// addTestBook adds a book through the API, returning it as stored.
+func addTestBook(t *testing.T, h http.Handler, form url.Values) Book {
+	t.Helper()
+	w, resp := send(t, h, "POST", "/book", form, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /book: %d %s", w.Code, w.Body.String())
+	}
+	var book Book
+	decode(t, resp, &book)
+	return book
+}
+
+// addTestNote adds a note to the book through the API, returning it as stored.
+func addTestNote(t *testing.T, h http.Handler, bookID primitive.ObjectID, form url.Values) Note {
+	t.Helper()
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set("bookID", bookID.Hex())
+	if form.Get("content") == "" {
+		form.Set("content", "a note")
+	}
+	w, resp := send(t, h, "POST", "/note", form, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /note: %d %s", w.Code, w.Body.String())
+	}
+	var note Note
+	decode(t, resp, &note)
+	return note
+}
@@ -0,0 +1,19 @@
+package tracker
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+)
+
+// goldmark drops raw HTML and unsafe links unless told otherwise, so the
+// output can be embedded as-is.
+var markdown = goldmark.New()
+
+func renderMarkdown(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
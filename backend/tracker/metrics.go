@@ -0,0 +1,214 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Metric names start with TRACKER_METRICS_PREFIX, e.g. tracker_requests_total.
+var metrics = newMetricsRegistry(envString("TRACKER_METRICS_PREFIX", "tracker"))
+
+// Upper bounds in seconds of the latency buckets, as Prometheus defaults them
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations per bucket of latencyBuckets, not cumulated.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+type requestKey struct {
+	method, route string
+	status        int
+}
+
+type routeKey struct {
+	method, route string
+}
+
+// metricsRegistry keeps what GET /metrics serves in the Prometheus text
+// format. It is small enough not to need a client library.
+type metricsRegistry struct {
+	mu             sync.Mutex
+	prefix         string
+	requests       map[requestKey]uint64
+	requestLatency map[routeKey]*histogram
+	mongoLatency   map[string]*histogram
+	mongoFailures  map[string]uint64
+}
+
+func newMetricsRegistry(prefix string) *metricsRegistry {
+	return &metricsRegistry{
+		prefix:         prefix,
+		requests:       map[requestKey]uint64{},
+		requestLatency: map[routeKey]*histogram{},
+		mongoLatency:   map[string]*histogram{},
+		mongoFailures:  map[string]uint64{},
+	}
+}
+
+func (m *metricsRegistry) observeRequest(method, route string, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{method, route, status}]++
+	key := routeKey{method, route}
+	if m.requestLatency[key] == nil {
+		m.requestLatency[key] = &histogram{}
+	}
+	m.requestLatency[key].observe(latency.Seconds())
+}
+
+func (m *metricsRegistry) observeMongo(command string, latency time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mongoLatency[command] == nil {
+		m.mongoLatency[command] = &histogram{}
+	}
+	m.mongoLatency[command].observe(latency.Seconds())
+	if failed {
+		m.mongoFailures[command]++
+	}
+}
+
+// Metrics counts every request and its latency per route. Unknown routes are
+// counted together, so scanners can't blow up the number of series.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.observeRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// mongoMonitor times every command the driver sends, see Database.clientOptions.
+func mongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			metrics.observeMongo(e.CommandName, time.Duration(e.DurationNanos), false)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			metrics.observeMongo(e.CommandName, time.Duration(e.DurationNanos), true)
+		},
+	}
+}
+
+// GetMetrics serves the metrics in the Prometheus text format.
+func GetMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(c.Writer)
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name := m.prefix + "_requests_total"
+	fmt.Fprintf(w, "# HELP %s Requests handled, per route and status.\n# TYPE %s counter\n", name, name)
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, key := range requests {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels("method", key.method, "route", key.route, "status", strconv.Itoa(key.status)), m.requests[key])
+	}
+
+	name = m.prefix + "_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to handle requests, per route.\n# TYPE %s histogram\n", name, name)
+	routes := make([]routeKey, 0, len(m.requestLatency))
+	for key := range m.requestLatency {
+		routes = append(routes, key)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, key := range routes {
+		writeHistogram(w, name, m.requestLatency[key], "method", key.method, "route", key.route)
+	}
+
+	name = m.prefix + "_mongo_command_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken by MongoDB commands, per command.\n# TYPE %s histogram\n", name, name)
+	commands := make([]string, 0, len(m.mongoLatency))
+	for command := range m.mongoLatency {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		writeHistogram(w, name, m.mongoLatency[command], "command", command)
+	}
+
+	name = m.prefix + "_mongo_command_failures_total"
+	fmt.Fprintf(w, "# HELP %s MongoDB commands that failed, per command.\n# TYPE %s counter\n", name, name)
+	for _, command := range commands {
+		if n := m.mongoFailures[command]; n > 0 {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, labels("command", command), n)
+		}
+	}
+}
+
+// writeHistogram writes the cumulated buckets, sum and count of h.
+func writeHistogram(w io.Writer, name string, h *histogram, pairs ...string) {
+	var cumulated uint64
+	for i, bound := range latencyBuckets {
+		cumulated += h.buckets[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, labels(append(pairs, "le", le)...), cumulated)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, labels(append(pairs, "le", "+Inf")...), h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels(pairs...), h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(pairs...), h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name, value pairs as name="value",...
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
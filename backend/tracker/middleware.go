@@ -0,0 +1,175 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errInternal      = errors.New("internal server error")
+	errRouteNotFound = errors.New("route not found")
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestID"
+)
+
+// RequestLogger assigns every request an id and logs one line per request
+// once the handler chain has finished.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		logInfof("request_id=%s method=%s path=%s status=%d latency=%s client_ip=%s",
+			id,
+			c.Request.Method,
+			c.Request.URL.Path,
+			c.Writer.Status(),
+			time.Since(start),
+			c.ClientIP(),
+		)
+	}
+}
+
+// CORS lets the origins listed in TRACKER_CORS_ORIGINS ("*" for any) call the
+// API, answering their preflight requests. It returns nil when no origin is
+// allowed, browsers then refuse every cross-origin call.
+func CORS() gin.HandlerFunc {
+	origins := envList("TRACKER_CORS_ORIGINS", nil)
+	if len(origins) == 0 {
+		return nil
+	}
+	config := cors.Config{
+		AllowedOrigins: origins,
+		AllowedMethods: envList("TRACKER_CORS_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"}),
+		AllowedHeaders: envList("TRACKER_CORS_HEADERS", []string{
+			"Origin", "Content-Type", "If-None-Match", "Prefer", idempotencyKeyHeader,
+		}),
+		ExposedHeaders: []string{
+			"Content-Length", requestIDHeader, "Retry-After", "Deprecation", "Warning", "ETag",
+			"X-Total-Count", "X-Page", "X-Page-Size", "Content-Disposition", "Preference-Applied",
+		},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}
+	if len(origins) == 1 && origins[0] == "*" {
+		config.AllowedOrigins = nil
+		config.AllowAllOrigins = true
+		config.AllowCredentials = false
+	}
+	if err := config.Validate(); err != nil {
+		logErrorf("CORS disabled: %v", err)
+		return nil
+	}
+	return cors.New(config)
+}
+
+// Recovery turns a panic in a handler into a 500 envelope, logging the stack.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				logErrorf("request_id=%s panic: %v\n%s", RequestID(c), r, debug.Stack())
+				ResponseError(c, errInternal)
+				c.Abort()
+			}
+		}()
+		c.Next()
+	}
+}
+
+// NotFound answers unknown routes with the usual error envelope.
+func NotFound(c *gin.Context) {
+	ResponseFailure(c, errRouteNotFound, http.StatusNotFound)
+}
+
+// Deprecated flags responses of a superseded route, telling clients which
+// method to switch to.
+func Deprecated(method string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Warning", `299 - "deprecated, use `+method+` `+c.FullPath()+`"`)
+		c.Next()
+	}
+}
+
+// RequestID returns the id assigned to the request by RequestLogger.
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// BodyLimit refuses request bodies over maxBytes with a 413. The body is read
+// up front so handlers parsing it never see a truncated form.
+func BodyLimit(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			ResponseFailure(c, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			c.Abort()
+			return
+		}
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+		c.Request.Body.Close()
+		if err != nil {
+			ResponseBadRequest(c, err)
+			c.Abort()
+			return
+		}
+		if int64(len(body)) > maxBytes {
+			ResponseFailure(c, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+var errReadOnly = errors.New("the tracker is read-only for now, try again later")
+
+// ReadOnly refuses the writes it guards with a 503 while enabled, e.g. during
+// a migration. Reads are never guarded.
+func ReadOnly(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if enabled {
+			c.Header("Retry-After", "600")
+			ResponseFailure(c, errReadOnly, http.StatusServiceUnavailable)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,59 @@
+package tracker
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNotFound(t *testing.T) {
+	h := newTestRouter(t)
+	tests := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{"unknown path", "GET", "/no/such/route"},
+		{"unknown path under a known one", "GET", "/book/list/extra/segments"},
+		{"unknown method", "TRACE", "/book"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, tt.method, tt.target, nil, nil)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body.String())
+			}
+			if resp.Success || resp.Error != errRouteNotFound.Error() {
+				t.Errorf("envelope = %+v, want the route not found error", resp)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		want    int
+	}{
+		{"panic", func(c *gin.Context) { panic("boom") }, http.StatusInternalServerError},
+		{"panic with an error", func(c *gin.Context) { panic(errBookNotFound) }, http.StatusInternalServerError},
+		{"no panic", func(c *gin.Context) { ResponseSuccess(c, "ok") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(Recovery())
+			router.GET("/", tt.handler)
+
+			w, resp := send(t, router, "GET", "/", nil, nil)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusInternalServerError && (resp.Success || resp.Error != errInternal.Error()) {
+				t.Errorf("envelope = %+v, want the internal error", resp)
+			}
+		})
+	}
+}
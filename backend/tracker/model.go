@@ -1,27 +1,486 @@
 package tracker
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Book reading status
+const (
+	StatusToRead = iota
+	StatusReading
+	StatusFinished
+	// given up before the end, doesn't count as read
+	StatusAbandoned
+)
+
+var statusNames = map[string]int{
+	"to_read":   StatusToRead,
+	"reading":   StatusReading,
+	"finished":  StatusFinished,
+	"abandoned": StatusAbandoned,
+}
+
 type Book struct {
 	ID          primitive.ObjectID   `json:"id"`
 	Title       string               `json:"title"`
 	Author      string               `json:"author"`
+	Authors     []string             `json:"authors"`
 	Status      int                  `json:"status"`
 	StartTime   time.Time            `json:"startTime"`
 	EndTime     time.Time            `json:"endTime"`
 	Notes       []primitive.ObjectID `json:"notes"`
 	Description string               `json:"description"`
+	Series      string               `json:"series"`
+	SeriesOrder int                  `json:"seriesOrder"`
+	// lowercase labels, see normalizeTags
+	Tags []string `json:"tags,omitempty"`
+	// page count, 0 when unknown
+	TotalPages int `json:"totalPages,omitempty"`
+	// unique when set, stored without hyphens or spaces
+	ISBN string `json:"isbn,omitempty"`
+	// unique, derived from the title for GET /book/by-slug/:slug, empty for
+	// books added before slugs existed
+	Slug string `json:"slug,omitempty"`
+	// 0 to maxRating, nil until rated
+	Rating *int `json:"rating,omitempty" bson:"rating,omitempty"`
+	// quickly captured stub, left out of ListBook until published
+	IsDraft bool `json:"isDraft"`
+	// the book this entry re-reads, see POST /book/:bookid/reread
+	RereadOf *primitive.ObjectID `json:"rereadOf,omitempty" bson:"rereadof,omitempty"`
+	// who has the book, set by POST /book/:bookid/lend until it's returned
+	LentTo string     `json:"lentTo,omitempty" bson:"lentto,omitempty"`
+	LentAt *time.Time `json:"lentAt,omitempty" bson:"lentat,omitempty"`
+	// GridFS file of the uploaded cover, served at CoverURL
+	CoverID  *primitive.ObjectID `json:"-" bson:"coverid,omitempty"`
+	CoverURL string              `json:"coverURL,omitempty" bson:"-"`
+	// set once by addBook, zero for books added before it was tracked
+	CreatedAt time.Time `json:"createdAt" bson:"createdat"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// last time a note of the book was added or edited
+	LastActivityAt time.Time `json:"lastActivityAt"`
+	// computed on read for finished books, never stored
+	DaysToRead *int `json:"daysToRead,omitempty" bson:"-"`
+	// hours needed to read an unfinished book, computed by GetBook
+	EstimatedHours *float64 `json:"estimatedHours,omitempty" bson:"-"`
+}
+
+// bookFields maps the json name of each stored Book field to its bson key.
+var bookFields = map[string]string{
+	"id":             "id",
+	"title":          "title",
+	"author":         "author",
+	"authors":        "authors",
+	"status":         "status",
+	"startTime":      "starttime",
+	"endTime":        "endtime",
+	"notes":          "notes",
+	"description":    "description",
+	"series":         "series",
+	"seriesOrder":    "seriesorder",
+	"totalPages":     "totalpages",
+	"tags":           "tags",
+	"isbn":           "isbn",
+	"slug":           "slug",
+	"rating":         "rating",
+	"lentTo":         "lentto",
+	"lentAt":         "lentat",
+	"createdAt":      "createdat",
+	"updatedAt":      "updatedat",
+	"lastActivityAt": "lastactivityat",
+}
+
+// afterRead fills in what isn't stored as is on every book read.
+func (b *Book) afterRead() {
+	// books written before co-authors existed only have Author
+	if len(b.Authors) == 0 && b.Author != "" {
+		b.Authors = []string{b.Author}
+	}
+	b.setDaysToRead()
+	b.CoverURL = ""
+	if b.CoverID != nil {
+		b.CoverURL = coverURL(b.ID)
+	}
+}
+
+// setAuthors sets Authors and keeps Author as the first of them.
+func (b *Book) setAuthors(authors []string) {
+	b.Authors = authors
+	b.Author = ""
+	if len(authors) > 0 {
+		b.Author = authors[0]
+	}
+}
+
+// normalizeTags lowercases the tags, dropping blank and repeated ones while
+// keeping their order.
+func normalizeTags(values []string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range values {
+		tag = strings.ToLower(normalizeSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// normalizeISBN drops the hyphens and spaces of an ISBN, e.g. "978-0-13-110362-7".
+func normalizeISBN(s string) string {
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+	return strings.ToUpper(s)
+}
+
+// slugify lowercases the title and joins its words with hyphens, e.g.
+// "The Go Programming Language!" becomes "the-go-programming-language".
+func slugify(title string) string {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, "-")
+}
+
+// Ratings go from 0 to maxRating stars
+const maxRating = 5
+
+// parseRating reads a rating, "" leaves the book unrated.
+func parseRating(s string) (*int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	rating, err := strconv.Atoi(s)
+	if err != nil || rating < 0 || rating > maxRating {
+		return nil, fmt.Errorf("rating must be a number from 0 to %d", maxRating)
+	}
+	return &rating, nil
+}
+
+var errEndBeforeStart = errors.New("endTime can't be before startTime")
+
+// checkReadingTimes rejects an end time before the start time. Zero times
+// are unset and never conflict.
+func checkReadingTimes(start, end time.Time) error {
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return errEndBeforeStart
+	}
+	return nil
+}
+
+// warnings lists suspicious but accepted data on the book.
+func (b *Book) warnings() []string {
+	var warnings []string
+	if b.Status == StatusFinished && b.EndTime.IsZero() {
+		warnings = append(warnings, "book is finished but has no endTime")
+	}
+	// an abandoned book may keep the day it was put down
+	if b.Status != StatusFinished && b.Status != StatusAbandoned && !b.EndTime.IsZero() {
+		warnings = append(warnings, "book has an endTime but isn't finished")
+	}
+	return warnings
+}
+
+// setDaysToRead fills in DaysToRead when the book is finished and both
+// timestamps are known.
+func (b *Book) setDaysToRead() {
+	b.DaysToRead = nil
+	if b.Status != StatusFinished || b.StartTime.IsZero() || b.EndTime.IsZero() || b.EndTime.Before(b.StartTime) {
+		return
+	}
+	days := int(b.EndTime.Sub(b.StartTime).Hours() / 24)
+	b.DaysToRead = &days
+}
+
+// setEstimatedHours fills in EstimatedHours at pagesPerHour, rounded to a
+// tenth, for unfinished books with a known page count.
+func (b *Book) setEstimatedHours(pagesPerHour float64) {
+	b.EstimatedHours = nil
+	if b.Status == StatusFinished || b.TotalPages <= 0 || pagesPerHour <= 0 {
+		return
+	}
+	hours := math.Round(float64(b.TotalPages)/pagesPerHour*10) / 10
+	b.EstimatedHours = &hours
+}
+
+// parseTotalPages reads a page count, "" when unknown.
+func parseTotalPages(s string) (int, error) {
+	pages, err := optionalInt(strings.TrimSpace(s))
+	if err != nil || pages < 0 {
+		return 0, errors.New("totalPages must be a positive number")
+	}
+	return pages, nil
+}
+
+// DurationStats is the average time taken to read the finished books.
+type DurationStats struct {
+	AverageDays float64 `json:"averageDays" bson:"averageDays"`
+	Count       int     `json:"count"`
+}
+
+// Streak counts the consecutive days, or weeks, on which a book was finished
+// or a note written. LastActive is the start of the last active one.
+type Streak struct {
+	Unit       string `json:"unit"`
+	Current    int    `json:"current"`
+	Longest    int    `json:"longest"`
+	LastActive string `json:"lastActive,omitempty"`
+}
+
+// IncompleteBook is a book missing some metadata, Missing names what, e.g.
+// "author" or "rating".
+type IncompleteBook struct {
+	Book
+	Missing []string `json:"missing"`
+}
+
+// BookBatch is the result of fetching books by id, Missing lists the ids
+// without a book.
+type BookBatch struct {
+	Books   []Book               `json:"books"`
+	Missing []primitive.ObjectID `json:"missing"`
+}
+
+// StatusBatch is the result of setting one status on several books. Edited
+// counts the books changed, Rejected lists the ones left as they were.
+type StatusBatch struct {
+	Edited   int             `json:"edited"`
+	Rejected []BookRejection `json:"rejected"`
+	// the ids of the books whose status changed
+	moved []primitive.ObjectID
+}
+
+// BookRejection is a book a batch left alone, Error tells why.
+type BookRejection struct {
+	ID    primitive.ObjectID `json:"id"`
+	Error string             `json:"error"`
+}
+
+// FieldCount is how many books share a value of a field.
+type FieldCount struct {
+	Value interface{} `json:"value" bson:"_id"`
+	Count int         `json:"count"`
+}
+
+// bookWithNotes is a Book with its notes inlined instead of referenced by id.
+type bookWithNotes struct {
+	Book
+	Notes []Note `json:"notes"`
+}
+
+// SeriesCount is the number of books filed under a series.
+type SeriesCount struct {
+	Name  string `json:"name" bson:"_id"`
+	Count int    `json:"count"`
 }
 
+// Note queries use these bson keys, keep them in sync when renaming fields.
 type Note struct {
-	ID      primitive.ObjectID `json:"id"`
-	BookID  primitive.ObjectID `json:"bookID"`
+	ID     primitive.ObjectID `json:"id" bson:"id"`
+	BookID primitive.ObjectID `json:"bookID" bson:"bookid"`
 	// Title string `json:"Title"`
-	Content string             `json:"content"`
-	ReplyTo primitive.ObjectID `json:"replyTo"`
-	// CreateTime time.Time `json:"createTime"`
+	Content string             `json:"content" bson:"content"`
+	ReplyTo primitive.ObjectID `json:"replyTo" bson:"replyto"`
+	// where in the book the note refers to, both optional
+	Page     int    `json:"page,omitempty" bson:"page"`
+	Location string `json:"location,omitempty" bson:"location"`
+	// highlight color, one of noteColors or empty
+	Color string `json:"color,omitempty" bson:"color"`
+	// kind of note, one of noteTypes or empty
+	Type string `json:"type,omitempty" bson:"type"`
+	// who said it, for quotes
+	Attribution string `json:"attribution,omitempty" bson:"attribution"`
+	// checked off while reviewing, false for new notes
+	Read bool `json:"read" bson:"read"`
+	// kept on top of the book's notes with pinnedFirst=true
+	Pinned bool `json:"pinned" bson:"pinned"`
+	// position among the book's notes, set by POST /book/:bookid/notes/reorder
+	Order      int       `json:"order" bson:"order"`
+	CreateTime time.Time `json:"createTime" bson:"createtime"`
+	// sequence number of the latest edit sent with one, older ones are skipped
+	EditSeq int64 `json:"-" bson:"editseq,omitempty"`
+	// previous contents, oldest first, served by GET /note/:noteid/history.
+	// Left out until the first edit, $push can't append to a null.
+	History []NoteRevision `json:"-" bson:"history,omitempty"`
+}
+
+// NoteEdit is the outcome of one edit of POST /note/batch. Skipped edits lost
+// to a later sequence number, Error tells why a failed one did.
+type NoteEdit struct {
+	ID      primitive.ObjectID `json:"id"`
+	Edited  bool               `json:"edited"`
+	Skipped bool               `json:"skipped,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// renderedNote is a Note with its markdown content rendered to HTML.
+type renderedNote struct {
+	noteWithBook
+	ContentHTML string `json:"contentHTML"`
+}
+
+// noteColors is the highlight palette notes can be tagged with.
+var noteColors = map[string]bool{
+	"yellow": true,
+	"green":  true,
+	"blue":   true,
+	"pink":   true,
+	"purple": true,
+}
+
+// parseColor accepts an empty color or one from noteColors.
+func parseColor(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s != "" && !noteColors[s] {
+		return "", fmt.Errorf("unknown color %q", s)
+	}
+	return s, nil
+}
+
+// noteTypes separates verbatim quotes from my own commentary.
+var noteTypes = map[string]bool{
+	"quote":    true,
+	"thought":  true,
+	"summary":  true,
+	"question": true,
+}
+
+// parseNoteType accepts an empty type or one from noteTypes.
+func parseNoteType(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s != "" && !noteTypes[s] {
+		return "", fmt.Errorf("unknown note type %q", s)
+	}
+	return s, nil
+}
+
+// NoteMatch is a note found by a search. Matches are the [start, end)
+// character offsets of every match in the content, Snippet surrounds the
+// first one.
+type NoteMatch struct {
+	Note
+	Snippet string   `json:"snippet"`
+	Matches [][2]int `json:"matches"`
+}
+
+// SearchResult is a book or a note found by GET /search, Type tells which.
+// Score ranks fuzzy book matches, 1 being an exact one.
+type SearchResult struct {
+	Type  string     `json:"type"`
+	Book  *Book      `json:"book,omitempty"`
+	Note  *NoteMatch `json:"note,omitempty"`
+	Score float64    `json:"score,omitempty"`
+}
+
+// ScoredBook is a book found by a fuzzy search, with how close it came.
+type ScoredBook struct {
+	Book
+	Score float64 `json:"score"`
+}
+
+// UndoResult tells what POST /undo restored: Kind is "book", "note" or
+// "notes" for all the notes of a book, Notes how many notes came back.
+type UndoResult struct {
+	Kind   string              `json:"kind"`
+	BookID *primitive.ObjectID `json:"bookID,omitempty"`
+	Notes  int                 `json:"notes"`
+}
+
+// BookNoteCount is how many notes a book has.
+type BookNoteCount struct {
+	BookID    primitive.ObjectID `json:"bookID" bson:"_id"`
+	BookTitle string             `json:"bookTitle" bson:"bookTitle"`
+	Count     int                `json:"count" bson:"count"`
+}
+
+// noteWithBook is a Note carrying the title of its book, when asked for.
+type noteWithBook struct {
+	Note      `bson:",inline"`
+	BookTitle string `json:"bookTitle,omitempty" bson:"bookTitle"`
+}
+
+type NoteRevision struct {
+	Content  string    `json:"content" bson:"content"`
+	EditTime time.Time `json:"editTime" bson:"edittime"`
+}
+
+// statusName is the name of a status, or its number if it has none.
+func statusName(status int) string {
+	for name, s := range statusNames {
+		if s == status {
+			return name
+		}
+	}
+	return strconv.Itoa(status)
+}
+
+// parseStatus accepts a status name such as "reading" or its numeric value.
+func parseStatus(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if status, ok := statusNames[strings.ToLower(s)]; ok {
+		return status, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		for _, status := range statusNames {
+			if status == n {
+				return n, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", s)
+}
+
+// parseStatusList parses a comma separated list of statuses.
+func parseStatusList(s string) ([]int, error) {
+	var statuses []int
+	for _, part := range strings.Split(s, ",") {
+		status, err := parseStatus(part)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// statusTransitions lists the statuses a book can move to from each status.
+var statusTransitions = map[int][]int{
+	StatusToRead:    {StatusReading},
+	StatusReading:   {StatusToRead, StatusFinished, StatusAbandoned},
+	StatusFinished:  {},
+	StatusAbandoned: {StatusReading},
+}
+
+// checkTransition tells whether a book can go from status from to status to.
+// Keeping the same status is always allowed.
+func checkTransition(from, to int) error {
+	if from == to {
+		return nil
+	}
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("status can't change from %s to %s", statusName(from), statusName(to))
+}
+
+// Goal is the number of books to finish in a year.
+type Goal struct {
+	Year   int `json:"year"`
+	Target int `json:"target"`
+}
+
+type GoalProgress struct {
+	Goal
+	Finished int     `json:"finished"`
+	Percent  float64 `json:"percent"`
 }
@@ -0,0 +1,56 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckReadingTimes(t *testing.T) {
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		start, end time.Time
+		want       error
+	}{
+		{"both unset", time.Time{}, time.Time{}, nil},
+		{"start unset", time.Time{}, day, nil},
+		{"end unset", day, time.Time{}, nil},
+		{"same time", day, day, nil},
+		{"end after start", day, day.AddDate(0, 0, 3), nil},
+		{"end before start", day, day.Add(-time.Second), errEndBeforeStart},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkReadingTimes(tt.start, tt.end); got != tt.want {
+				t.Errorf("checkReadingTimes(%v, %v) = %v, want %v", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from, to int
+		ok       bool
+	}{
+		{StatusToRead, StatusToRead, true},
+		{StatusToRead, StatusReading, true},
+		{StatusToRead, StatusFinished, false},
+		{StatusToRead, StatusAbandoned, false},
+		{StatusReading, StatusToRead, true},
+		{StatusReading, StatusFinished, true},
+		{StatusReading, StatusAbandoned, true},
+		{StatusFinished, StatusFinished, true},
+		{StatusFinished, StatusReading, false},
+		{StatusFinished, StatusToRead, false},
+		{StatusAbandoned, StatusReading, true},
+		{StatusAbandoned, StatusFinished, false},
+	}
+	for _, tt := range tests {
+		t.Run(statusName(tt.from)+" to "+statusName(tt.to), func(t *testing.T) {
+			if err := checkTransition(tt.from, tt.to); (err == nil) != tt.ok {
+				t.Errorf("checkTransition(%d, %d) = %v, want ok %v", tt.from, tt.to, err, tt.ok)
+			}
+		})
+	}
+}
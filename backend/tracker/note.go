@@ -1,23 +1,31 @@
 package tracker
 
 import (
-	"fmt"
-	"log"
+	"errors"
+	"regexp"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
-	noteCol = "note"
+	// Keep at most N previous contents per note
+	noteHistoryLimit = 20
+	// Follow at most N replyTo links up a thread
+	maxReplyDepth = 100
 )
 
 func listNote(query map[string]string) (notes []Note, err error) {
-	client, ctx, cancel := getConnection()
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return notes, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(noteCol)
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
 
 	listAll := true
 	for _, v := range query {
@@ -28,127 +36,225 @@ func listNote(query map[string]string) (notes []Note, err error) {
 	if listAll == true {
 		cursor, err := collection.Find(ctx, bson.M{})
 		if err != nil {
-			log.Fatal(err)
+			logErrorf("%v", err)
 			return notes, err
 		}
 		defer cursor.Close(ctx)
 
 		for cursor.Next(ctx) {
 			var note Note
-			if err = cursor.Decode(&note); err != nil {
-				log.Fatal(err)
-				return notes, err
-			} else {
-				notes = append(notes, note)
+			if err := cursor.Decode(&note); err != nil {
+				logErrorf("skipping note %v: %v", cursor.Current.Lookup("id"), err)
+				continue
 			}
+			notes = append(notes, note)
 		}
-		return notes, nil
+		return notes, cursor.Err()
 	} else {
 		var filter bson.D
 		for k, v := range query {
 			if v != "" {
-				fmt.Println(v)
-				if err != nil {
-					log.Fatal(err)
-				}
-				filter = append(filter, bson.E{k, v})
+				logDebugf("filter: %s=%s", k, v)
+				filter = append(filter, eqLiteral(k, v))
 			}
 		}
 		cursor, err := collection.Find(ctx, filter)
 		if err != nil {
-			log.Fatal(err)
+			logErrorf("%v", err)
 			return notes, err
 		}
 		defer cursor.Close(ctx)
 
 		for cursor.Next(ctx) {
 			var note Note
-			if err = cursor.Decode(&note); err != nil {
-				log.Fatal(err)
-				return notes, err
-			} else {
-				notes = append(notes, note)
+			if err := cursor.Decode(&note); err != nil {
+				logErrorf("skipping note %v: %v", cursor.Current.Lookup("id"), err)
+				continue
 			}
+			notes = append(notes, note)
 		}
-		return notes, nil
+		return notes, cursor.Err()
 	}
 }
 
 func listNoteByBook(bookID primitive.ObjectID) (notes []Note, err error) {
 	book, err := getBook(bookID)
 	if err != nil {
-		log.Fatal(err)
+		logErrorf("%v", err)
 		return notes, err
 	}
 
-	noteIDs := book.Notes
+	return listNoteByID(book.Notes)
+}
+
+// listNoteByID fetches the notes in one query, in the order of ids.
+// Ids without a note are skipped.
+func listNoteByID(ids []primitive.ObjectID) (notes []Note, err error) {
+	notes = []Note{}
+	if len(ids) == 0 {
+		return notes, nil
+	}
 
-	client, ctx, cancel := getConnection()
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return notes, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(noteCol)
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	cursor, err := collection.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err != nil {
+		logErrorf("%v", err)
+		return notes, err
+	}
+	defer cursor.Close(ctx)
 
-	for _, noteID := range noteIDs {
+	var found []Note
+	for cursor.Next(ctx) {
 		var note Note
-		res := collection.FindOne(ctx, bson.M{"id": noteID})
-		res.Decode(&note)
-		notes = append(notes, note)
+		// one malformed note, e.g. mid-migration, doesn't fail the whole list
+		if err := cursor.Decode(&note); err != nil {
+			logErrorf("skipping note %v: %v", cursor.Current.Lookup("id"), err)
+			continue
+		}
+		found = append(found, note)
+	}
+	if err = cursor.Err(); err != nil {
+		logErrorf("%v", err)
+		return notes, err
 	}
 
+	byID := make(map[primitive.ObjectID]Note, len(found))
+	for _, note := range found {
+		byID[note.ID] = note
+	}
+	for _, id := range ids {
+		if note, ok := byID[id]; ok {
+			notes = append(notes, note)
+		}
+	}
 	return notes, nil
 }
 
-func getNote(noteID primitive.ObjectID) (note Note, err error) {
-	client, ctx, cancel := getConnection()
+// listReplies returns the direct replies to the note, oldest first.
+func listReplies(noteID primitive.ObjectID) (notes []Note, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return notes, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
-	collection := client.Database(db).Collection(noteCol)
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createtime", Value: 1}, {Key: "id", Value: 1}}).
+		SetProjection(bson.M{"history": 0})
+	cursor, err := collection.Find(ctx, bson.M{"replyto": noteID}, opts)
+	if err != nil {
+		logErrorf("%v", err)
+		return notes, err
+	}
+	notes = []Note{}
+	if err = cursor.All(ctx, &notes); err != nil {
+		logErrorf("%v", err)
+		return notes, err
+	}
+	return notes, nil
+}
+
+// notePath walks up the replyTo links of note, returning its ancestors from
+// the root of the thread down to its parent. A link to a deleted note ends
+// the walk, as does a loop or a thread deeper than maxReplyDepth.
+func notePath(note Note) ([]Note, error) {
+	path := []Note{}
+	visited := map[primitive.ObjectID]bool{note.ID: true}
+	for parentID := note.ReplyTo; !parentID.IsZero(); {
+		if visited[parentID] || len(path) == maxReplyDepth {
+			logErrorf("reply chain of Note %s loops or is too deep, stopped at %s", note.ID.Hex(), parentID.Hex())
+			break
+		}
+		visited[parentID] = true
 
-	res := collection.FindOne(ctx, bson.M{"id": noteID})
-	res.Decode(&note)
+		parent, err := getNote(parentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent.ID.IsZero() {
+			break
+		}
+		parent.History = nil
+		path = append(path, parent)
+		parentID = parent.ReplyTo
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
 
-	return note, nil
+func getNote(noteID primitive.ObjectID) (note Note, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return note, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	err = collection.FindOne(ctx, bson.M{"id": noteID}).Decode(&note)
+	if err == mongo.ErrNoDocuments {
+		return note, nil
+	}
+	if err != nil {
+		logErrorf("Could not get Note: %v", err)
+	}
+	return note, err
 }
 
 func addNote(bookID primitive.ObjectID, note *Note) (primitive.ObjectID, error) {
 
-	client, ctx, cancel := getConnection()
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
+
+	// get the book's old note array
+	book, err := getBook(note.BookID)
+	if err != nil {
+		logErrorf("Could not create Note: %v", err)
+		return primitive.NilObjectID, err
+	}
 
 	note.ID = primitive.NewObjectID()
+	note.CreateTime = time.Now()
+	// new notes go last
+	note.Order = len(book.Notes)
 
-	collection := client.Database(db).Collection(noteCol)
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
 
 	// insert a new note
 	res, err := collection.InsertOne(ctx, note)
 	if err != nil {
-		log.Printf("Could not create Note: %v", err)
+		logErrorf("Could not create Note: %v", err)
 		return primitive.NilObjectID, err
 	}
 	// default id
 	_ = res.InsertedID.(primitive.ObjectID)
 
-	// get the book's old note array
-	book, err := getBook(note.BookID)
-	if err != nil {
-		log.Printf("Could not create Note: %v", err)
-		return primitive.NilObjectID, err
-	}
-
 	oldNotes := book.Notes
 	oldNotes = append(oldNotes, note.ID)
 
 	fields := make(map[string]interface{})
-	fields["id"] = bookID
 	fields["notes"] = oldNotes
+	fields["lastactivityat"] = note.CreateTime
 
 	// append new note id to the book's note array
-	_, err = editBook(fields)
+	_, err = editBook(bookID, fields)
 	if err != nil {
-		log.Printf("Could not link the note to the Book: %v", err)
+		logErrorf("Could not link the note to the Book: %v", err)
 		_, _ = deleteNote(note.ID)
 		return primitive.NilObjectID, err
 	}
@@ -158,22 +264,611 @@ func addNote(bookID primitive.ObjectID, note *Note) (primitive.ObjectID, error)
 }
 
 func deleteNote(noteID primitive.ObjectID) (int, error) {
-	client, ctx, cancel := getConnection()
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
 	defer cancel()
-	defer client.Disconnect(ctx)
 
 	// get note
 	// get book
 	// delete note and book's note at the same time
-	collection := client.Database(db).Collection(noteCol)
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	// kept for POST /undo
+	note, err := snapshot(ctx, collection, bson.M{"id": noteID})
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
 
 	res, err := collection.DeleteOne(ctx, bson.M{"id": noteID})
 	if err != nil {
-		log.Fatal(err)
+		logErrorf("%v", err)
 		return int(res.DeletedCount), err
 	}
 
+	if res.DeletedCount > 0 && len(note) > 0 {
+		// the book still lists the note, reinserting it is enough
+		bookID, _ := note[0].Lookup("bookid").ObjectIDOK()
+		undoBuffer.push(deletion{kind: deletedNote, bookID: bookID, notes: note})
+	}
 	return int(res.DeletedCount), nil
 }
 
+// bookTitleLookup returns the aggregation stages adding bookTitle to notes.
+func bookTitleLookup() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from":         database.BookCollection,
+			"localField":   "bookid",
+			"foreignField": "id",
+			"as":           "book",
+		}}},
+		{{Key: "$addFields", Value: bson.M{"bookTitle": bson.M{"$arrayElemAt": bson.A{"$book.title", 0}}}}},
+		{{Key: "$project", Value: bson.M{"book": 0, "history": 0}}},
+	}
+}
+
+// getNoteWithBook is getNote plus the title of the note's book.
+func getNoteWithBook(noteID primitive.ObjectID) (note noteWithBook, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return note, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"id": noteID}}},
+	}, bookTitleLookup()...)
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return note, err
+	}
+	defer cursor.Close(ctx)
+
+	if cursor.Next(ctx) {
+		err = cursor.Decode(&note)
+	}
+	return note, err
+}
+
+// listAllNote pages through the notes matching filter ordered by creation
+// time, each with the title of its book.
+func listAllNote(filter bson.D, skip, limit int64, ascending bool) (notes []noteWithBook, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return notes, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	order := -1
+	if ascending {
+		order = 1
+	}
+	if filter == nil {
+		filter = bson.D{}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: bson.D{{Key: "createtime", Value: order}, {Key: "id", Value: order}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+	}
+	pipeline = append(pipeline, bookTitleLookup()...)
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return notes, err
+	}
+	notes = []noteWithBook{}
+	if err = cursor.All(ctx, &notes); err != nil {
+		logErrorf("%v", err)
+		return notes, err
+	}
+	return notes, nil
+}
+
+// countNote counts the notes matching filter, across every page of a list.
+func countNote(filter bson.D) (int64, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	if filter == nil {
+		filter = bson.D{}
+	}
+	var count int64
+	err = retryRead(ctx, func() (err error) {
+		count, err = collection.CountDocuments(ctx, filter)
+		return err
+	})
+	if err != nil {
+		logErrorf("%v", err)
+	}
+	return count, err
+}
+
+// noteCountByBook counts the notes of each book, most annotated first, ties
+// by book id, keeping the first limit.
+func noteCountByBook(limit int64) (counts []BookNoteCount, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return counts, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"bookid": bson.M{"$nin": bson.A{primitive.NilObjectID, nil}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$bookid", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         database.BookCollection,
+			"localField":   "_id",
+			"foreignField": "id",
+			"as":           "book",
+		}}},
+		{{Key: "$addFields", Value: bson.M{"bookTitle": bson.M{"$arrayElemAt": bson.A{"$book.title", 0}}}}},
+		{{Key: "$project", Value: bson.M{"book": 0}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logErrorf("%v", err)
+		return counts, err
+	}
+	counts = []BookNoteCount{}
+	if err = cursor.All(ctx, &counts); err != nil {
+		logErrorf("%v", err)
+		return counts, err
+	}
+	return counts, nil
+}
+
+// searchNote finds up to limit notes containing q, ignoring case, newest first.
+func searchNote(q string, limit int64) (matches []NoteMatch, err error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return matches, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	pattern := regexp.QuoteMeta(q)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createtime", Value: -1}}).
+		SetLimit(limit).
+		SetProjection(bson.M{"history": 0})
+	cursor, err := collection.Find(ctx, bson.M{"content": primitive.Regex{Pattern: pattern, Options: "i"}}, opts)
+	if err != nil {
+		logErrorf("%v", err)
+		return matches, err
+	}
+	var notes []Note
+	if err = cursor.All(ctx, &notes); err != nil {
+		logErrorf("%v", err)
+		return matches, err
+	}
+
+	re := regexp.MustCompile("(?i)" + pattern)
+	matches = []NoteMatch{}
+	for _, note := range notes {
+		matches = append(matches, matchNote(note, re))
+	}
+	return matches, nil
+}
+
+var (
+	// errNoteEdited is returned when the note's content changed during an edit.
+	errNoteEdited = errors.New("the note was edited meanwhile, reload and retry")
+	// errStaleEdit is returned when an edit with a later sequence number
+	// was applied already.
+	errStaleEdit = errors.New("a later edit of the note was applied already")
+)
+
+// editNote sets the given note fields. A new content pushes the old one onto
+// the note's history. An "editseq" field only applies the edit if no edit with
+// the same or a later sequence number did. It returns mongo.ErrNoDocuments if
+// the note doesn't exist.
+func editNote(noteID primitive.ObjectID, fields map[string]interface{}) (int, error) {
+	set := bson.M{}
+	for k, v := range fields {
+		if v != "" {
+			set[k] = v
+		}
+	}
+	if len(set) == 0 {
+		// nothing to change, but a missing note is still an error
+		note, err := getNote(noteID)
+		if err != nil {
+			return 0, err
+		}
+		if note.ID.IsZero() {
+			return 0, mongo.ErrNoDocuments
+		}
+		return 0, nil
+	}
+
+	filter := bson.M{"id": noteID}
+	update := bson.M{"$set": set}
+	seq, hasSeq := set["editseq"]
+	if hasSeq {
+		// also matches notes never edited with a sequence number
+		filter["editseq"] = bson.M{"$not": bson.M{"$gte": seq}}
+	}
+	if content, ok := set["content"]; ok {
+		note, err := getNote(noteID)
+		if err != nil {
+			return 0, err
+		}
+		if note.ID.IsZero() {
+			return 0, mongo.ErrNoDocuments
+		}
+		if content != note.Content {
+			revision := NoteRevision{
+				Content:  note.Content,
+				EditTime: time.Now(),
+			}
+			// matching on the old content keeps a concurrent edit from being lost from the history
+			filter["content"] = note.Content
+			update["$push"] = bson.M{"history": bson.M{
+				"$each":  []NoteRevision{revision},
+				"$slice": -noteHistoryLimit,
+			}}
+		}
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logErrorf("Could not edit Note: %v", err)
+		return 0, err
+	}
+	if result.MatchedCount == 0 {
+		if hasSeq {
+			note, err := getNote(noteID)
+			if err != nil {
+				return 0, err
+			}
+			if note.ID.IsZero() {
+				return 0, mongo.ErrNoDocuments
+			}
+			if note.EditSeq >= seq.(int64) {
+				return 0, errStaleEdit
+			}
+		}
+		// the note exists, so only its content can have stopped matching
+		if _, ok := filter["content"]; ok {
+			return 0, errNoteEdited
+		}
+		return 0, mongo.ErrNoDocuments
+	}
+	if result.ModifiedCount > 0 {
+		if note, err := getNote(noteID); err == nil && !note.BookID.IsZero() {
+			_ = touchBook(note.BookID, time.Now())
+		}
+	}
+	return int(result.ModifiedCount), nil
+}
+
+// deleteNoteByBook deletes every note of the book and empties its notes, in
+// one transaction. It returns mongo.ErrNoDocuments if the book doesn't exist.
+func deleteNoteByBook(bookID primitive.ObjectID) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	books := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	var deleted int
+	var undo deletion
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			// kept for POST /undo
+			var book Book
+			if err := books.FindOne(sc, bson.M{"id": bookID}).Decode(&book); err != nil {
+				return nil, err
+			}
+			deletedNotes, err := snapshot(sc, notes, bson.M{"bookid": bookID})
+			if err != nil {
+				return nil, err
+			}
+			undo = deletion{kind: deletedBookNotes, bookID: bookID, notes: deletedNotes, bookNotes: book.Notes}
+
+			res, err := books.UpdateOne(sc, bson.M{"id": bookID}, bson.M{
+				"$set": bson.M{"notes": []primitive.ObjectID{}, "updatedat": time.Now()},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if res.MatchedCount == 0 {
+				return nil, mongo.ErrNoDocuments
+			}
+			del, err := notes.DeleteMany(sc, bson.M{"bookid": bookID})
+			if err != nil {
+				return nil, err
+			}
+			deleted = int(del.DeletedCount)
+			return nil, nil
+		})
+		return err
+	})
+	bookCache.invalidate(bookID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		logErrorf("Could not delete the notes of Book %s: %v", bookID.Hex(), err)
+	}
+	if err == nil && (len(undo.notes) > 0 || len(undo.bookNotes) > 0) {
+		undoBuffer.push(undo)
+	}
+	return deleted, err
+}
+
+// addNotes inserts one note per content, in order, and appends them all to the
+// book in one transaction. It returns mongo.ErrNoDocuments if the book doesn't exist.
+func addNotes(bookID primitive.ObjectID, contents []string) ([]primitive.ObjectID, error) {
+	book, err := getBook(bookID)
+	if err != nil {
+		return nil, err
+	}
+	if book.ID.IsZero() {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	now := time.Now()
+	ids := make([]primitive.ObjectID, len(contents))
+	docs := make([]interface{}, len(contents))
+	for i, content := range contents {
+		ids[i] = primitive.NewObjectID()
+		docs[i] = Note{
+			ID:         ids[i],
+			BookID:     bookID,
+			Content:    content,
+			Order:      len(book.Notes) + i,
+			CreateTime: now,
+		}
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	books := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			if _, err := notes.InsertMany(sc, docs, options.InsertMany().SetOrdered(true)); err != nil {
+				return nil, err
+			}
+			res, err := books.UpdateOne(sc, bson.M{"id": bookID}, bson.M{
+				"$push": bson.M{"notes": bson.M{"$each": ids}},
+				"$set":  bson.M{"updatedat": now, "lastactivityat": now},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if res.MatchedCount == 0 {
+				return nil, mongo.ErrNoDocuments
+			}
+			return nil, nil
+		})
+		return err
+	})
+	bookCache.invalidate(bookID)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logErrorf("Could not import Notes to Book %s: %v", bookID.Hex(), err)
+		}
+		return nil, err
+	}
+	return ids, nil
+}
+
+// setNoteFlag sets the boolean note field key, e.g. read. It returns
+// mongo.ErrNoDocuments if the note doesn't exist.
+func setNoteFlag(noteID primitive.ObjectID, key string, value bool) (int, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	res, err := collection.UpdateOne(ctx, bson.M{"id": noteID}, bson.M{"$set": bson.M{key: value}})
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	if res.MatchedCount == 0 {
+		return 0, mongo.ErrNoDocuments
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// readNoteByBook marks every note of the book read. It returns
+// mongo.ErrNoDocuments if the book doesn't exist.
+func readNoteByBook(bookID primitive.ObjectID) (int, error) {
+	book, err := getBook(bookID)
+	if err != nil {
+		return 0, err
+	}
+	if book.ID.IsZero() {
+		return 0, mongo.ErrNoDocuments
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.NoteCollection)
+
+	res, err := collection.UpdateMany(ctx,
+		bson.M{"bookid": bookID, "read": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"read": true}},
+	)
+	if err != nil {
+		logErrorf("%v", err)
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// unlinkNote detaches the note from its book without deleting it, in one
+// transaction. It returns mongo.ErrNoDocuments if the note doesn't exist.
+func unlinkNote(noteID primitive.ObjectID) (int, error) {
+	note, err := getNote(noteID)
+	if err != nil {
+		return 0, err
+	}
+	if note.ID.IsZero() {
+		return 0, mongo.ErrNoDocuments
+	}
+	if note.BookID.IsZero() {
+		return 0, nil
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	books := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	var unlinked int
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			_, err := books.UpdateOne(sc, bson.M{"id": note.BookID}, bson.M{
+				"$pull": bson.M{"notes": noteID},
+				"$set":  bson.M{"updatedat": time.Now()},
+			})
+			if err != nil {
+				return nil, err
+			}
+			res, err := notes.UpdateOne(sc, bson.M{"id": noteID}, bson.M{"$set": bson.M{"bookid": primitive.NilObjectID}})
+			if err != nil {
+				return nil, err
+			}
+			unlinked = int(res.ModifiedCount)
+			return nil, nil
+		})
+		return err
+	})
+	bookCache.invalidate(note.BookID)
+	if err != nil {
+		logErrorf("Could not unlink Note %s: %v", noteID.Hex(), err)
+	}
+	return unlinked, err
+}
+
+// unlinkedNoteFilter matches the notes belonging to no book.
+var unlinkedNoteFilter = bson.D{{Key: "bookid", Value: bson.M{"$in": bson.A{primitive.NilObjectID, nil}}}}
+
+var (
+	errNoteOrder   = errors.New("ids must list every note of the book exactly once")
+	errNoteChanged = errors.New("the book's notes changed, reload and retry")
+)
+
+// reorderNote stores ids as the order of the book's notes, in one
+// transaction. ids must be a permutation of the book's notes: a note added or
+// removed meanwhile fails with errNoteChanged rather than being lost.
+func reorderNote(bookID primitive.ObjectID, ids []primitive.ObjectID) error {
+	book, err := getBook(bookID)
+	if err != nil {
+		return err
+	}
+	if book.ID.IsZero() {
+		return mongo.ErrNoDocuments
+	}
+	if !samePermutation(book.Notes, ids) {
+		return errNoteOrder
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	books := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			res, err := books.UpdateOne(sc, bson.M{"id": bookID, "notes": book.Notes}, bson.M{
+				"$set": bson.M{"notes": ids, "updatedat": time.Now()},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if res.MatchedCount == 0 {
+				return nil, errNoteChanged
+			}
+			if len(ids) == 0 {
+				return nil, nil
+			}
+			models := make([]mongo.WriteModel, len(ids))
+			for i, id := range ids {
+				models[i] = mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"id": id}).
+					SetUpdate(bson.M{"$set": bson.M{"order": i}})
+			}
+			_, err = notes.BulkWrite(sc, models)
+			return nil, err
+		})
+		return err
+	})
+	bookCache.invalidate(bookID)
+	if err != nil && err != errNoteChanged {
+		logErrorf("Could not reorder the notes of Book %s: %v", bookID.Hex(), err)
+	}
+	return err
+}
+
+// samePermutation reports whether a and b hold the same ids, each once.
+func samePermutation(a, b []primitive.ObjectID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[primitive.ObjectID]int, len(a))
+	for _, id := range a {
+		seen[id]++
+	}
+	for _, id := range b {
+		if seen[id] != 1 {
+			return false
+		}
+		seen[id] = 0
+	}
+	return true
+}
+
 // func deleteNoteFromBook(){}
@@ -0,0 +1,342 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNoteHistory(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"History"}})
+
+	tests := []struct {
+		name  string
+		edits []string
+		want  []string
+	}{
+		{"never edited", nil, []string{}},
+		{"edited once", []string{"second"}, []string{"first"}},
+		{"edited twice", []string{"second", "third"}, []string{"first", "second"}},
+		{"same content", []string{"first"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			note := addTestNote(t, h, book.ID, url.Values{"content": {"first"}})
+			target := "/note/" + note.ID.Hex()
+			for _, content := range tt.edits {
+				if w, _ := send(t, h, "PATCH", target, url.Values{"content": {content}}, nil); w.Code != http.StatusOK {
+					t.Fatalf("PATCH %s: %d %s", target, w.Code, w.Body.String())
+				}
+			}
+
+			w, resp := send(t, h, "GET", target+"/history", nil, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s/history: %d %s", target, w.Code, w.Body.String())
+			}
+			var history []NoteRevision
+			decode(t, resp, &history)
+			got := []string{}
+			for _, revision := range history {
+				got = append(got, revision.Content)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("history = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("history = %q, want %q", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	t.Run("unknown note", func(t *testing.T) {
+		target := "/note/" + primitive.NewObjectID().Hex() + "/history"
+		if w, _ := send(t, h, "GET", target, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d, want %d", target, w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestEditNote(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Edited notes"}})
+	note := addTestNote(t, h, book.ID, nil)
+	unknown := primitive.NewObjectID()
+
+	tests := []struct {
+		name     string
+		id       primitive.ObjectID
+		form     url.Values
+		wantCode int
+	}{
+		{"content", note.ID, url.Values{"content": {"edited"}}, http.StatusOK},
+		{"nothing to change", note.ID, url.Values{}, http.StatusOK},
+		{"unknown note", unknown, url.Values{"content": {"edited"}}, http.StatusNotFound},
+		{"unknown note, nothing to change", unknown, url.Values{}, http.StatusNotFound},
+		{"unknown note, location only", unknown, url.Values{"location": {"p. 3"}}, http.StatusNotFound},
+		{"overlong content", note.ID, url.Values{"content": {strings.Repeat("a", maxNoteLength+1)}}, http.StatusBadRequest},
+		{"blank content", note.ID, url.Values{"content": {"  "}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/note/" + tt.id.Hex()
+			if w, _ := send(t, h, "PATCH", target, tt.form, nil); w.Code != tt.wantCode {
+				t.Errorf("PATCH %s: %d, want %d: %s", target, w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetNote(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Notes"}})
+	note := addTestNote(t, h, book.ID, nil)
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+	}{
+		{"note", "/note/" + note.ID.Hex(), http.StatusOK},
+		{"unknown note", "/note/" + primitive.NewObjectID().Hex(), http.StatusNotFound},
+		{"invalid id", "/note/nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, "GET", tt.target, nil, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("GET %s: %d, want %d: %s", tt.target, w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == http.StatusOK {
+				var got Note
+				decode(t, resp, &got)
+				if got.ID != note.ID {
+					t.Errorf("got note %s, want %s", got.ID.Hex(), note.ID.Hex())
+				}
+			}
+		})
+	}
+}
+
+func TestGetNoteDatabaseDown(t *testing.T) {
+	h := newTestRouter(t)
+	target := "/note/" + primitive.NewObjectID().Hex()
+	if w, _ := send(t, h, "GET", target, nil, nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("GET %s: %d, want %d", target, w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestAddNoteContent(t *testing.T) {
+	h := newTestRouter(t)
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing", ""},
+		{"blank", " \n\t"},
+		{"too long", strings.Repeat("é", maxNoteLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"bookID": {primitive.NewObjectID().Hex()}, "content": {tt.content}}
+			w, resp := send(t, h, "POST", "/note", form, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body.String())
+			}
+			if want := checkNoteContent(tt.content).Error(); resp.Error != want {
+				t.Errorf("error = %q, want %q", resp.Error, want)
+			}
+		})
+	}
+}
+
+func TestAddNoteReply(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Thread"}})
+	parent := addTestNote(t, h, book.ID, nil)
+	other := addTestBook(t, h, url.Values{"title": {"Other"}})
+	elsewhere := addTestNote(t, h, other.ID, nil)
+
+	tests := []struct {
+		name     string
+		replyTo  string
+		wantCode int
+	}{
+		{"no reply", "", http.StatusOK},
+		{"reply", parent.ID.Hex(), http.StatusOK},
+		{"note of another book", elsewhere.ID.Hex(), http.StatusBadRequest},
+		{"unknown note", primitive.NewObjectID().Hex(), http.StatusBadRequest},
+		{"not an id", "nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"bookID": {book.ID.Hex()}, "content": {"a reply"}, "replyTo": {tt.replyTo}}
+			w, resp := send(t, h, "POST", "/note", form, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var note Note
+			decode(t, resp, &note)
+			if note.ReplyTo.Hex() != tt.replyTo && !(tt.replyTo == "" && note.ReplyTo.IsZero()) {
+				t.Errorf("replyTo = %s, want %q", note.ReplyTo.Hex(), tt.replyTo)
+			}
+		})
+	}
+
+	w, resp := send(t, h, "GET", "/note/"+parent.ID.Hex()+"/replies", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET replies: %d %s", w.Code, w.Body.String())
+	}
+	var replies []Note
+	decode(t, resp, &replies)
+	if len(replies) != 1 || replies[0].ReplyTo != parent.ID {
+		t.Errorf("replies = %+v, want the one reply", replies)
+	}
+}
+
+func TestListNoteByBookID(t *testing.T) {
+	h := newTestRouter(t)
+	_, errInvalidID := primitive.ObjectIDFromHex("nope")
+	tests := []struct {
+		name      string
+		query     string
+		wantError string
+	}{
+		{"missing", "", "bookid is required"},
+		{"empty", "?bookid=", "bookid is required"},
+		{"blank", "?bookid=%20%20", "bookid is required"},
+		{"not an id", "?bookid=nope", errInvalidID.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, resp := send(t, h, "GET", "/note"+tt.query, nil, nil)
+			if w.Code != http.StatusBadRequest || resp.Error != tt.wantError {
+				t.Errorf("got %d %q, want %d %q", w.Code, resp.Error, http.StatusBadRequest, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestWritesReturnTheNote(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Noted"}, "status": {"0"}})
+	tests := []struct {
+		name   string
+		target func(id primitive.ObjectID) string
+		method string
+		form   url.Values
+		check  func(t *testing.T, got Note)
+	}{
+		{"add", func(primitive.ObjectID) string { return "/note" }, "POST",
+			url.Values{"bookID": {book.ID.Hex()}, "content": {"added"}},
+			func(t *testing.T, got Note) {
+				if got.Content != "added" || got.BookID != book.ID {
+					t.Errorf("content %q book %s", got.Content, got.BookID.Hex())
+				}
+			}},
+		{"edit", func(id primitive.ObjectID) string { return "/note/" + id.Hex() }, "PATCH",
+			url.Values{"content": {"edited"}},
+			func(t *testing.T, got Note) {
+				if got.Content != "edited" || got.BookID != book.ID {
+					t.Errorf("content %q book %s", got.Content, got.BookID.Hex())
+				}
+			}},
+		{"read", func(id primitive.ObjectID) string { return "/note/" + id.Hex() + "/read" }, "POST",
+			url.Values{},
+			func(t *testing.T, got Note) {
+				if !got.Read || got.Content != "a note" {
+					t.Errorf("read %v content %q, want the note read", got.Read, got.Content)
+				}
+			}},
+		{"unread", func(id primitive.ObjectID) string { return "/note/" + id.Hex() + "/read" }, "POST",
+			url.Values{"read": {"false"}},
+			func(t *testing.T, got Note) {
+				if got.Read {
+					t.Errorf("read = true, want the note unread")
+				}
+			}},
+		{"pin", func(id primitive.ObjectID) string { return "/note/" + id.Hex() + "/pin" }, "POST",
+			url.Values{},
+			func(t *testing.T, got Note) {
+				if !got.Pinned || got.Content != "a note" {
+					t.Errorf("pinned %v content %q, want the note pinned", got.Pinned, got.Content)
+				}
+			}},
+		{"unpin", func(id primitive.ObjectID) string { return "/note/" + id.Hex() + "/pin" }, "POST",
+			url.Values{"pinned": {"false"}},
+			func(t *testing.T, got Note) {
+				if got.Pinned {
+					t.Errorf("pinned = true, want the note unpinned")
+				}
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := addTestNote(t, h, book.ID, nil)
+			target := tt.target(existing.ID)
+			w, resp := send(t, h, tt.method, target, tt.form, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: %d %s", tt.method, target, w.Code, w.Body.String())
+			}
+			var got Note
+			decode(t, resp, &got)
+			tt.check(t, got)
+			// the fields only the server sets come back too
+			if got.ID.IsZero() || got.CreateTime.IsZero() {
+				t.Errorf("id %s createTime %v, want them set", got.ID.Hex(), got.CreateTime)
+			}
+		})
+	}
+}
+
+func TestCountNote(t *testing.T) {
+	h := newTestService(t)
+	book := addTestBook(t, h, url.Values{"title": {"Counted"}})
+	other := addTestBook(t, h, url.Values{"title": {"Other"}})
+	for i := 0; i < 3; i++ {
+		addTestNote(t, h, book.ID, nil)
+	}
+	addTestNote(t, h, other.ID, url.Values{"type": {"quote"}})
+	// unlinking runs in a transaction, store the unlinked note directly
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	unlinked := Note{ID: primitive.NewObjectID(), Content: "loose", CreateTime: time.Now()}
+	if _, err := testClient(t).Database(database.Name).Collection(database.NoteCollection).InsertOne(ctx, unlinked); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter bson.D
+		want   int64
+	}{
+		{"every note", nil, 5},
+		{"notes of a book", bson.D{{Key: "bookid", Value: book.ID}}, 3},
+		{"quotes", bson.D{{Key: "type", Value: "quote"}}, 1},
+		{"unlinked", unlinkedNoteFilter, 1},
+		{"none", bson.D{{Key: "bookid", Value: primitive.NewObjectID()}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := countNote(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("countNote = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
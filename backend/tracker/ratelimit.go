@@ -0,0 +1,87 @@
+package tracker
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Forget idle clients once this many are tracked
+const rateLimitMaxClients = 10000
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// RateLimit allows each client IP perMinute requests per minute, with bursts
+// of up to burst requests. Requests over the limit get a 429.
+func RateLimit(perMinute, burst int) gin.HandlerFunc {
+	l := &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	return func(c *gin.Context) {
+		if perMinute <= 0 {
+			c.Next()
+			return
+		}
+		ok, wait := l.allow(c.ClientIP())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			ResponseFailure(c, errRateLimited, http.StatusTooManyRequests)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// allow takes a token from the client's bucket, or reports how long until one
+// becomes available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitMaxClients {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops buckets that have refilled completely. Callers must hold l.mu.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
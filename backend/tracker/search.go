@@ -0,0 +1,121 @@
+package tracker
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Words kept on each side of the first match in a snippet
+const snippetWords = 5
+
+var word = regexp.MustCompile(`\S+`)
+
+// matchNote locates re in the note's content.
+func matchNote(note Note, re *regexp.Regexp) NoteMatch {
+	match := NoteMatch{
+		Note:    note,
+		Matches: [][2]int{},
+	}
+	locs := re.FindAllStringIndex(note.Content, -1)
+	for _, loc := range locs {
+		// offsets in characters rather than bytes, for clients
+		start := utf8.RuneCountInString(note.Content[:loc[0]])
+		end := start + utf8.RuneCountInString(note.Content[loc[0]:loc[1]])
+		match.Matches = append(match.Matches, [2]int{start, end})
+	}
+	if len(locs) > 0 {
+		match.Snippet = snippet(note.Content, locs[0][0], locs[0][1])
+	}
+	return match
+}
+
+// snippet returns text[start:end] with a few words on each side, marking
+// cut off text with an ellipsis.
+func snippet(text string, start, end int) string {
+	from, to := 0, len(text)
+	prefix, suffix := "", ""
+	if words := word.FindAllStringIndex(text[:start], -1); len(words) > snippetWords {
+		from = words[len(words)-snippetWords][0]
+		prefix = "…"
+	}
+	if words := word.FindAllStringIndex(text[end:], -1); len(words) > snippetWords {
+		to = end + words[snippetWords-1][1]
+		suffix = "…"
+	}
+	return prefix + strings.Join(strings.Fields(text[from:to]), " ") + suffix
+}
+
+// Titles scoring below minFuzzyScore aren't a fuzzy match
+const minFuzzyScore = 0.6
+
+// titleScore tells how close q is to title, from 0 to 1, ignoring case. q is
+// compared with every run of as many words in the title, so "gastby" scores
+// high against "The Great Gatsby".
+func titleScore(q, title string) float64 {
+	q = strings.ToLower(strings.Join(strings.Fields(q), " "))
+	words := strings.Fields(strings.ToLower(title))
+	n := len(strings.Fields(q))
+	if n == 0 || len(words) == 0 {
+		return 0
+	}
+
+	best := similarity(q, strings.Join(words, " "))
+	for i := 0; i+n <= len(words); i++ {
+		if score := similarity(q, strings.Join(words[i:i+n], " ")); score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// similarity is 1 minus the edit distance between a and b, relative to the
+// longest of them.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein counts the insertions, deletions, substitutions and swaps of
+// adjacent characters turning a into b, a swap being a common typo.
+func levenshtein(a, b []rune) int {
+	// d[i][j] is the distance between a[:i] and b[:j]
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,79 @@
+//go:build debug
+// +build debug
+
+package tracker
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Only built with -tags debug, it is not meant to be reachable in production.
+func init() {
+	debugRoutes = append(debugRoutes, func(router *gin.Engine) {
+		router.GET("/debug/transaction", TransactionCheck)
+	})
+}
+
+// TransactionCheck verifies transactions work by inserting a scratch book
+// inside a transaction and aborting it. Nothing is ever persisted.
+func TransactionCheck(c *gin.Context) {
+	if err := checkTransaction(); err != nil {
+		logErrorf("request_id=%s transaction check: %v", RequestID(c), err)
+		if transactionsUnsupported(err) {
+			ResponseFailure(c, errTransactionsUnsupported, http.StatusNotImplemented)
+			return
+		}
+		ResponseError(c, err)
+		return
+	}
+	ResponseSuccess(c, "transactions are working")
+}
+
+func checkTransaction() error {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	collection := client.Database(database.Name).Collection(database.BookCollection)
+
+	scratch := Book{
+		ID:    primitive.NewObjectID(),
+		Title: "transaction self-check",
+	}
+
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		if err := sc.StartTransaction(); err != nil {
+			return err
+		}
+		// always roll back, even if a step below fails
+		defer sc.AbortTransaction(sc)
+
+		if _, err := collection.InsertOne(sc, scratch); err != nil {
+			return err
+		}
+		if err := collection.FindOne(sc, bson.M{"id": scratch.ID}).Err(); err != nil {
+			return err
+		}
+		return sc.AbortTransaction(sc)
+	})
+	if err != nil {
+		return err
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"id": scratch.ID})
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return errors.New("aborted transaction left its write behind")
+	}
+	return nil
+}
@@ -1,26 +1,62 @@
 package tracker
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gin-gonic/contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
-func Server() {
+// debugRoutes are registered by files only built with -tags debug
+var debugRoutes []func(router *gin.Engine)
+
+// Wait up to N seconds for in-flight requests on shutdown
+const shutdownTimeout = 10
 
-	// use default
-	router := gin.Default()
+// Service is the tracker API: its routes and the database behind them.
+type Service struct {
+	db *Database
+	// books served by getBook, kept for TRACKER_BOOK_CACHE_TTL, at most
+	// TRACKER_BOOK_CACHE_SIZE of them. A size of 0 disables it.
+	books  *bookTTLCache
+	router *gin.Engine
+}
 
-	// router := gin.New()
+// NewService returns a Service storing its data in db, with every route
+// registered. The handlers share one database per process, so db replaces
+// the default one, and so does the Service's book cache.
+func NewService(db *Database) *Service {
+	books := newBookCache(
+		envDuration("TRACKER_BOOK_CACHE_TTL", time.Minute),
+		envInt("TRACKER_BOOK_CACHE_SIZE", 256),
+	)
+	database = db
+	bookCache = books
+
+	router := gin.New()
 
 	// Global middleware
-	// Logger middleware will write the logs to gin.DefaultWriter even if you set with GIN_MODE=release.
-	// By default gin.DefaultWriter = os.Stdout
-	// router.Use(gin.Logger())
+	// RequestLogger tags every request with an id and logs it once handled.
+	router.Use(RequestLogger())
+
+	// Metrics counts requests per route for GET /metrics.
+	metricsEnabled := envBool("TRACKER_METRICS", true)
+	if metricsEnabled {
+		router.Use(Metrics())
+	}
+
+	// Gzip compresses large responses, it wraps Recovery so 500s go through it too.
+	if envBool("TRACKER_GZIP", true) {
+		router.Use(Gzip(envInt("TRACKER_GZIP_MIN_SIZE", 1024)))
+	}
 
 	// Recovery middleware recovers from any panics and writes a 500 if there was one.
-	// router.Use(gin.Recovery())
+	router.Use(Recovery())
+	router.NoRoute(NotFound)
 
 	// session
 	// router.Use(sessions.Sessions("go_lib", cookie.NewStore([]byte("secret"))))
@@ -36,34 +72,156 @@ func Server() {
 	// 	})
 	// })
 
-	router.Use(cors.New(cors.Config{
-		// for dev
-		AllowAllOrigins: true,
-		// for prod
-		// AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE"},
-		AllowedHeaders:   []string{"Origin"},
-		ExposedHeaders:   []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	// cross-origin requests are refused unless their origin is allowed
+	if corsHandler := CORS(); corsHandler != nil {
+		router.Use(corsHandler)
+	}
+
+	// throttle writes per client, reads are left alone
+	writeLimit := RateLimit(
+		envInt("TRACKER_WRITE_RATE_PER_MINUTE", 60),
+		envInt("TRACKER_WRITE_BURST", 10),
+	)
+
+	// TRACKER_READ_ONLY=true refuses every write, reads keep working
+	readOnly := ReadOnly(envBool("TRACKER_READ_ONLY", false))
+
+	// bound the bodies of writes, batches get more room
+	bodyLimit := BodyLimit(int64(envInt("TRACKER_MAX_BODY_BYTES", 1<<20)))
+	batchBodyLimit := BodyLimit(int64(envInt("TRACKER_MAX_BATCH_BODY_BYTES", 8<<20)))
 
 	book := router.Group("/book")
 	{
 		book.GET("", ListBook)
-		book.POST("", AddBook)
+		book.POST("", readOnly, writeLimit, bodyLimit, AddBook)
+		book.POST("/batch/status", readOnly, writeLimit, batchBodyLimit, EditBookStatus)
+		book.POST("/batch/tags", readOnly, writeLimit, batchBodyLimit, EditBookTags)
+		book.POST("/batch-get", batchBodyLimit, BatchGetBook)
+		book.POST("/merge", readOnly, writeLimit, bodyLimit, MergeBook)
+		book.GET("/authors", ListAuthor)
+		book.GET("/distinct/:field", DistinctBookField)
+		book.GET("/random", RandomBook)
+		book.GET("/recent", ListRecentBook)
+		book.GET("/incomplete", ListIncompleteBook)
+		book.GET("/stats/duration", GetDurationStats)
+		book.GET("/stats/authors", GetTopAuthors)
+		book.GET("/series", ListSeries)
+		book.GET("/series/:name", ListSeriesBook)
+		book.GET("/by-slug/:slug", GetBookBySlug)
 		book.GET("/:bookid", GetBook)
-		book.DELETE("", DeleteBook)
-		book.POST("/:bookid", EditBook)
+		book.GET("/:bookid/next", NextInSeries)
+		book.GET("/:bookid/export.md", ExportBook)
+		book.DELETE("", readOnly, writeLimit, bodyLimit, DeleteBook)
+		book.DELETE("/:bookid/notes", readOnly, writeLimit, bodyLimit, DeleteNoteByBook)
+		book.POST("/:bookid/notes/reorder", readOnly, writeLimit, bodyLimit, ReorderNote)
+		book.POST("/:bookid/notes/batch", readOnly, writeLimit, batchBodyLimit, ImportNote)
+		book.POST("/:bookid/notes/read", readOnly, writeLimit, bodyLimit, ReadNoteByBook)
+		// PATCH is the partial update, POST stays as a deprecated alias for old clients
+		book.PATCH("/:bookid", readOnly, writeLimit, bodyLimit, EditBook)
+		book.PUT("/:bookid", readOnly, writeLimit, bodyLimit, ReplaceBook)
+		book.POST("/:bookid/publish", readOnly, writeLimit, bodyLimit, PublishBook)
+		// covers get room for the image and the multipart framing around it
+		book.POST("/:bookid/cover", readOnly, writeLimit, BodyLimit(int64(maxCoverBytes)+64<<10), UploadCover)
+		book.GET("/:bookid/cover", GetCover)
+		book.POST("/:bookid/lend", readOnly, writeLimit, bodyLimit, LendBook)
+		book.POST("/:bookid/return", readOnly, writeLimit, bodyLimit, ReturnBook)
+		book.POST("/:bookid/reread", readOnly, writeLimit, bodyLimit, RereadBook)
+		book.POST("/:bookid", readOnly, writeLimit, bodyLimit, Deprecated("PATCH"), EditBook)
 	}
 
 	note := router.Group("/note")
 	{
 		note.GET("", ListNoteByBook)
-		note.POST("", AddNote)
+		note.GET("/all", ListAllNote)
+		note.GET("/unlinked", ListUnlinkedNote)
+		note.GET("/stats", GetNoteStats)
+		note.GET("/search", SearchNote)
+		note.POST("", readOnly, writeLimit, bodyLimit, AddNote)
+		// editors flush their buffered autosaves here
+		note.POST("/batch", readOnly, writeLimit, batchBodyLimit, BatchEditNote)
 		note.GET("/:noteid", GetNote)
-		note.DELETE("/:noteid", DeleteNote)
-		// note.POST("/:noteid", EditNote)
+		note.DELETE("/:noteid", readOnly, writeLimit, bodyLimit, DeleteNote)
+		note.PATCH("/:noteid", readOnly, writeLimit, bodyLimit, EditNote)
+		note.POST("/:noteid", readOnly, writeLimit, bodyLimit, Deprecated("PATCH"), EditNote)
+		note.GET("/:noteid/history", GetNoteHistory)
+		note.GET("/:noteid/replies", ListReplies)
+		note.GET("/:noteid/path", GetNotePath)
+		note.POST("/:noteid/read", readOnly, writeLimit, bodyLimit, ReadNote)
+		note.POST("/:noteid/pin", readOnly, writeLimit, bodyLimit, PinNote)
+		note.POST("/:noteid/unlink", readOnly, writeLimit, bodyLimit, UnlinkNote)
+	}
+
+	// one search box for books and notes
+	router.GET("/search", Search)
+	router.GET("/stats/streak", GetStreak)
+	// puts back the last deleted book or notes
+	router.POST("/undo", readOnly, writeLimit, bodyLimit, Undo)
+
+	goal := router.Group("/goal")
+	{
+		goal.POST("", readOnly, writeLimit, bodyLimit, SetGoal)
+		goal.GET("/:year", GetGoal)
+	}
+
+	if metricsEnabled {
+		router.GET("/metrics", GetMetrics)
+	}
+
+	for _, register := range debugRoutes {
+		register(router)
 	}
-	router.Run(":8989")
+
+	return &Service{
+		db:     db,
+		books:  books,
+		router: router,
+	}
+}
+
+// Handler serves the API, e.g. from an httptest server.
+func (s *Service) Handler() http.Handler {
+	return s.router
+}
+
+// Close releases the database client.
+func (s *Service) Close(ctx context.Context) error {
+	return s.db.Close(ctx)
+}
+
+// Run serves on addr until SIGINT or SIGTERM, then shuts down gracefully.
+func (s *Service) Run(addr string) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: s.router,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errc:
+		logErrorf("server stopped: %v", err)
+	case sig := <-quit:
+		logInfof("received %s, shutting down", sig)
+	}
+
+	// let in-flight requests finish before the mongo client goes away
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logErrorf("server shutdown: %v", err)
+	}
+	if err := s.Close(ctx); err != nil {
+		logErrorf("mongo disconnect: %v", err)
+	}
+}
+
+// Server runs the tracker on the default database.
+func Server() {
+	NewService(database).Run(":8989")
 }
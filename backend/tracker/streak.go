@@ -0,0 +1,117 @@
+package tracker
+
+import (
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const dayLayout = "2006-01-02"
+
+// activeDays lists the days, in loc, on which a book was finished or a note
+// was written, oldest first. Each day is returned as midnight UTC.
+func activeDays(loc *time.Location) ([]time.Time, error) {
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	db := client.Database(database.Name)
+
+	// one document per distinct day of field among the documents matching match
+	daysOf := func(field string, match bson.M) mongo.Pipeline {
+		return mongo.Pipeline{
+			{{Key: "$match", Value: match}},
+			{{Key: "$group", Value: bson.M{"_id": bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$" + field, "timezone": loc.String()}}}}},
+		}
+	}
+	queries := []struct {
+		collection *mongo.Collection
+		pipeline   mongo.Pipeline
+	}{
+		{db.Collection(database.NoteCollection), daysOf("createtime", bson.M{"createtime": bson.M{"$gt": time.Time{}}})},
+		{db.Collection(database.BookCollection), daysOf("endtime", bson.M{"status": StatusFinished, "endtime": bson.M{"$gt": time.Time{}}})},
+	}
+
+	seen := make(map[string]bool)
+	for _, q := range queries {
+		cursor, err := q.collection.Aggregate(ctx, q.pipeline)
+		if err != nil {
+			logErrorf("%v", err)
+			return nil, err
+		}
+		var found []struct {
+			Day string `bson:"_id"`
+		}
+		if err = cursor.All(ctx, &found); err != nil {
+			logErrorf("%v", err)
+			return nil, err
+		}
+		for _, f := range found {
+			seen[f.Day] = true
+		}
+	}
+
+	days := make([]time.Time, 0, len(seen))
+	for day := range seen {
+		t, err := time.Parse(dayLayout, day)
+		if err != nil {
+			continue
+		}
+		days = append(days, t)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// periodStart is the start of the day, or of the week (on Monday), holding t
+// in its own location, as midnight UTC.
+func periodStart(t time.Time, weekly bool) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if weekly {
+		t = t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	}
+	return t
+}
+
+// computeStreak counts the consecutive active days or weeks in days, sorted
+// oldest first. The current streak is still alive when the last active
+// period is the one before now's, there's time left to extend it.
+func computeStreak(days []time.Time, weekly bool, now time.Time) Streak {
+	streak := Streak{Unit: "day"}
+	step := 1
+	if weekly {
+		streak.Unit = "week"
+		step = 7
+	}
+
+	var last time.Time
+	run := 0
+	for _, day := range days {
+		period := periodStart(day, weekly)
+		switch {
+		case run > 0 && period.Equal(last):
+			continue
+		case run > 0 && period.Equal(last.AddDate(0, 0, step)):
+			run++
+		default:
+			run = 1
+		}
+		last = period
+		if run > streak.Longest {
+			streak.Longest = run
+		}
+	}
+
+	current := periodStart(now, weekly)
+	if run > 0 && (last.Equal(current) || last.Equal(current.AddDate(0, 0, -step))) {
+		streak.Current = run
+	}
+	if run > 0 {
+		streak.LastActive = last.Format(dayLayout)
+	}
+	return streak
+}
@@ -0,0 +1,194 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The last TRACKER_UNDO_SIZE deletions can be undone for TRACKER_UNDO_TTL.
+// The buffer lives in memory, a restart empties it. Expired deletions are
+// only forgotten the next time the buffer is used.
+var undoBuffer = newUndoBuffer(
+	envInt("TRACKER_UNDO_SIZE", 10),
+	envDuration("TRACKER_UNDO_TTL", time.Hour),
+)
+
+var errNothingToUndo = errors.New("nothing to undo")
+
+// What a deletion removed
+const (
+	deletedBook      = "book"
+	deletedNote      = "note"
+	deletedBookNotes = "notes"
+)
+
+// deletion is enough to put deleted documents back as they were stored.
+type deletion struct {
+	kind   string
+	bookID primitive.ObjectID
+	book   bson.Raw
+	notes  []bson.Raw
+	// the note ids the book listed, when its notes were deleted
+	bookNotes []primitive.ObjectID
+	expires   time.Time
+}
+
+type undoStack struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries []deletion
+}
+
+func newUndoBuffer(size int, ttl time.Duration) *undoStack {
+	return &undoStack{size: size, ttl: ttl}
+}
+
+// push records a deletion, forgetting the oldest one when full.
+func (s *undoStack) push(d deletion) {
+	if s.size <= 0 || s.ttl <= 0 {
+		d.forget()
+		return
+	}
+	s.mu.Lock()
+	d.expires = time.Now().Add(s.ttl)
+	dropped := s.dropExpired()
+	s.entries = append(s.entries, d)
+	if len(s.entries) > s.size {
+		dropped = append(dropped, s.entries[:len(s.entries)-s.size]...)
+		s.entries = s.entries[len(s.entries)-s.size:]
+	}
+	s.mu.Unlock()
+
+	for _, d := range dropped {
+		d.forget()
+	}
+}
+
+// pop takes the latest deletion that hasn't expired.
+func (s *undoStack) pop() (deletion, bool) {
+	s.mu.Lock()
+	dropped := s.dropExpired()
+	var d deletion
+	ok := len(s.entries) > 0
+	if ok {
+		d = s.entries[len(s.entries)-1]
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+	s.mu.Unlock()
+
+	for _, d := range dropped {
+		d.forget()
+	}
+	return d, ok
+}
+
+// dropExpired removes the expired deletions, returning them. Callers must
+// hold s.mu.
+func (s *undoStack) dropExpired() []deletion {
+	now := time.Now()
+	var dropped []deletion
+	kept := s.entries[:0]
+	for _, d := range s.entries {
+		if now.Before(d.expires) {
+			kept = append(kept, d)
+		} else {
+			dropped = append(dropped, d)
+		}
+	}
+	s.entries = kept
+	return dropped
+}
+
+// forget drops what only the deletion still referred to, once it can't be
+// undone: the cover of a deleted book.
+func (d deletion) forget() {
+	if d.kind != deletedBook || d.book == nil {
+		return
+	}
+	if coverID, ok := d.book.Lookup("coverid").ObjectIDOK(); ok {
+		deleteCover(coverID)
+	}
+}
+
+// snapshot copies the documents of collection matching filter as stored.
+func snapshot(ctx context.Context, collection *mongo.Collection, filter interface{}) ([]bson.Raw, error) {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []bson.Raw
+	for cursor.Next(ctx) {
+		// Current is only valid until the next call
+		docs = append(docs, append(bson.Raw(nil), cursor.Current...))
+	}
+	return docs, cursor.Err()
+}
+
+// undoDelete puts back the latest deletion, in one transaction. A deletion
+// that can't be restored is kept for another try.
+func undoDelete() (UndoResult, error) {
+	d, ok := undoBuffer.pop()
+	if !ok {
+		return UndoResult{}, errNothingToUndo
+	}
+
+	client, ctx, cancel, err := getConnection()
+	if err != nil {
+		return UndoResult{}, err
+	}
+	defer cancel()
+
+	books := client.Database(database.Name).Collection(database.BookCollection)
+	notes := client.Database(database.Name).Collection(database.NoteCollection)
+
+	err = client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			if d.book != nil {
+				if _, err := books.InsertOne(sc, d.book); err != nil {
+					return nil, err
+				}
+			}
+			if len(d.notes) > 0 {
+				docs := make([]interface{}, len(d.notes))
+				for i, note := range d.notes {
+					docs[i] = note
+				}
+				if _, err := notes.InsertMany(sc, docs); err != nil {
+					return nil, err
+				}
+			}
+			if len(d.bookNotes) > 0 {
+				// ahead of any note added since
+				_, err := books.UpdateOne(sc, bson.M{"id": d.bookID}, bson.M{
+					"$push": bson.M{"notes": bson.M{"$each": d.bookNotes, "$position": 0}},
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		return err
+	})
+	bookCache.invalidate(d.bookID)
+	if err != nil {
+		logErrorf("Could not undo the deletion of %s %s: %v", d.kind, d.bookID.Hex(), err)
+		undoBuffer.push(d)
+		return UndoResult{}, err
+	}
+
+	result := UndoResult{Kind: d.kind, Notes: len(d.notes)}
+	if !d.bookID.IsZero() {
+		result.BookID = &d.bookID
+	}
+	return result, nil
+}
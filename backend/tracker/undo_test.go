@@ -0,0 +1,52 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUndoStack(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	tests := []struct {
+		name   string
+		size   int
+		ttl    time.Duration
+		pushed int
+		wait   time.Duration
+		want   []primitive.ObjectID
+	}{
+		{"latest first", 10, time.Hour, 3, 0, []primitive.ObjectID{ids[2], ids[1], ids[0]}},
+		{"oldest pushed out", 2, time.Hour, 3, 0, []primitive.ObjectID{ids[2], ids[1]}},
+		{"expired", 10, time.Millisecond, 3, 5 * time.Millisecond, nil},
+		{"disabled by size", 0, time.Hour, 3, 0, nil},
+		{"disabled by ttl", 10, 0, 3, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUndoBuffer(tt.size, tt.ttl)
+			for _, id := range ids[:tt.pushed] {
+				s.push(deletion{kind: deletedNote, bookID: id})
+			}
+			time.Sleep(tt.wait)
+
+			var got []primitive.ObjectID
+			for {
+				d, ok := s.pop()
+				if !ok {
+					break
+				}
+				got = append(got, d.bookID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("popped %d deletions, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("deletion %d = %s, want %s", i, got[i].Hex(), tt.want[i].Hex())
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,35 @@
 package tracker
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
 type serverResponse struct {
-	Success bool
-	Data    interface{} `json:",omitempty"`
-	Error   string      `json:",omitempty"`
+	Success  bool
+	Data     interface{} `json:",omitempty"`
+	Error    string      `json:",omitempty"`
+	Warnings []string    `json:",omitempty"`
+	// number of items matching a list request, across every page
+	Total *int64 `json:",omitempty"`
+	// every problem of an invalid request, by field
+	Errors []FieldError `json:",omitempty"`
 }
 
 func ResponseSuccess(c *gin.Context, data interface{}) {
@@ -19,6 +39,25 @@ func ResponseSuccess(c *gin.Context, data interface{}) {
 	})
 }
 
+// ResponseList is a success carrying a list of items, total counts the items
+// matching the request when data is only one page of them.
+func ResponseList(c *gin.Context, items interface{}, total int64) {
+	c.JSON(http.StatusOK, serverResponse{
+		Success: true,
+		Data:    items,
+		Total:   &total,
+	})
+}
+
+// ResponseWarning is a success carrying non-fatal remarks about the request.
+func ResponseWarning(c *gin.Context, data interface{}, warnings []string) {
+	c.JSON(http.StatusOK, serverResponse{
+		Success:  true,
+		Data:     data,
+		Warnings: warnings,
+	})
+}
+
 func ResponseError(c *gin.Context, err error) {
 	ResponseFailure(c, err, http.StatusInternalServerError)
 }
@@ -32,6 +71,12 @@ func ResponseUnauthorized(c *gin.Context, err error) {
 }
 
 func ResponseFailure(c *gin.Context, err error, code int) {
+	// no request is to blame for the database being unavailable, whatever
+	// the handler answers other failures with
+	if errors.Is(err, errNoDatabase) {
+		logErrorf("request_id=%s %v", RequestID(c), err)
+		err, code = errNoDatabase, http.StatusInternalServerError
+	}
 	resp := serverResponse{
 		Success: false,
 	}
@@ -40,3 +85,282 @@ func ResponseFailure(c *gin.Context, err error, code int) {
 	}
 	c.JSON(code, resp)
 }
+
+// ResponseWriteError answers a failed insert or update: 409 naming the field
+// when it collided with a unique index, 400 otherwise.
+func ResponseWriteError(c *gin.Context, err error) {
+	if field, ok := duplicateKeyField(err); ok {
+		ResponseFailure(c, fmt.Errorf("%s is already used by another book", field), http.StatusConflict)
+		return
+	}
+	ResponseBadRequest(c, err)
+}
+
+var errTransactionsUnsupported = errors.New("this needs MongoDB transactions, which require a replica set or a sharded cluster")
+
+// ResponseTransactionError answers a failed transactional write: 501 when the
+// server can't run transactions, like ResponseWriteError otherwise.
+func ResponseTransactionError(c *gin.Context, err error) {
+	if transactionsUnsupported(err) {
+		logErrorf("request_id=%s %v", RequestID(c), err)
+		ResponseFailure(c, errTransactionsUnsupported, http.StatusNotImplemented)
+		return
+	}
+	ResponseWriteError(c, err)
+}
+
+// transactionsUnsupported tells whether err comes from a transaction sent to
+// a standalone server, which only replica sets and mongos accept.
+func transactionsUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == illegalOperationCode {
+		return strings.Contains(cmdErr.Message, "Transaction numbers")
+	}
+	// the message is all some wrapped errors keep
+	return strings.Contains(err.Error(), "Transaction numbers are only allowed")
+}
+
+// Server error code of e.g. a transaction on a standalone server
+const illegalOperationCode = 20
+
+// bookETag changes whenever the book is edited, and with variant, which
+// holds whatever else shaped the body sent.
+func bookETag(book Book, variant string) string {
+	sum := sha1.Sum([]byte(book.ID.Hex() + book.UpdatedAt.UTC().Format(time.RFC3339Nano) + variant))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatch reports whether an If-None-Match header matches etag.
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseObjectIDs parses a non-empty list of hex ids, failing on the first invalid one.
+func parseObjectIDs(hexes []string) ([]primitive.ObjectID, error) {
+	if len(hexes) == 0 {
+		return nil, errors.New("ids are required")
+	}
+	ids := make([]primitive.ObjectID, 0, len(hexes))
+	for _, h := range hexes {
+		id, err := primitive.ObjectIDFromHex(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", h)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// eqLiteral is the filter element matching key against value, taken
+// literally. An implicit equality would read a document value such as
+// {"$ne": ""} as an operator and match nearly everything, $eq compares it as
+// data. key must never come from the client.
+func eqLiteral(key string, value interface{}) bson.E {
+	return bson.E{Key: key, Value: bson.M{"$eq": value}}
+}
+
+// Batch endpoints take at most N items per request
+var maxBatchSize = envInt("TRACKER_MAX_BATCH_SIZE", 500)
+
+// checkBatchSize rejects a batch of n items sent as the form value key when
+// it's over maxBatchSize.
+func checkBatchSize(key string, n int) error {
+	if n > maxBatchSize {
+		return fmt.Errorf("%s has %d items, at most %d are accepted per request", key, n, maxBatchSize)
+	}
+	return nil
+}
+
+// normalizeSpace trims s and collapses inner runs of whitespace to a single
+// space, keeping the casing as sent. Multi-line text such as descriptions
+// should only be trimmed.
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Page size when pageSize isn't sent, and the largest one served.
+var (
+	defaultPageSize = envInt("TRACKER_DEFAULT_PAGE_SIZE", 20)
+	maxPageSize     = envInt("TRACKER_MAX_PAGE_SIZE", 100)
+)
+
+// parsePage reads the 1-based page and pageSize query params, shared by every
+// paginated list.
+func parsePage(c *gin.Context) (skip int64, limit int64, err error) {
+	page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("page must be a positive number")
+	}
+	size, err := strconv.ParseInt(c.DefaultQuery("pageSize", strconv.Itoa(defaultPageSize)), 10, 64)
+	if err != nil || size < 1 {
+		return 0, 0, errors.New("pageSize must be a positive number")
+	}
+	if size > int64(maxPageSize) {
+		size = int64(maxPageSize)
+	}
+	return (page - 1) * size, size, nil
+}
+
+// parseTZ reads the tz query param, an IANA zone such as "America/New_York",
+// UTC when not sent.
+func parseTZ(c *gin.Context) (*time.Location, error) {
+	tz := c.Query("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	// Go's name for the server's zone, which mongo doesn't know
+	if tz == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", tz)
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", tz)
+	}
+	return loc, nil
+}
+
+// pageWanted tells whether the client asked for a page rather than the whole list.
+func pageWanted(c *gin.Context) bool {
+	return c.Query("page") != "" || c.Query("pageSize") != ""
+}
+
+// pickFields keeps only the given json fields of each book.
+func pickFields(books []Book, fields []string) []map[string]interface{} {
+	picked := make([]map[string]interface{}, 0, len(books))
+	for _, book := range books {
+		b, err := json.Marshal(book)
+		if err != nil {
+			continue
+		}
+		var all map[string]interface{}
+		if err := json.Unmarshal(b, &all); err != nil {
+			continue
+		}
+		m := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			m[field] = all[field]
+		}
+		picked = append(picked, m)
+	}
+	return picked
+}
+
+// optionalInt parses an optional numeric form value, empty meaning 0.
+func optionalInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+const (
+	retryMaxAttempts = 3
+	retryBaseDelay   = 50 * time.Millisecond
+)
+
+// retryRead runs an idempotent read, retrying transient errors with
+// exponential backoff until it succeeds, runs out of attempts or ctx is done.
+// Never use it for writes, a retried insert may be applied twice.
+func retryRead(ctx context.Context, op func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == retryMaxAttempts || !isTransientError(err) {
+			return err
+		}
+		logDebugf("transient mongo error, attempt %d: %v", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// labeledError is a server error, or one the driver reports for the server,
+// e.g. mongo.CommandError and mongo.WriteException. Later drivers call it
+// mongo.ServerError.
+type labeledError interface {
+	error
+	HasErrorLabel(label string) bool
+}
+
+// Labels of the errors a retry may get past, e.g. a dropped connection or an
+// election in progress
+var transientLabels = []string{"NetworkError", "RetryableWriteError", "TransientTransactionError"}
+
+// isTransientError tells whether err may go away on a retry: a network error,
+// a timeout or a server error labelled as retryable.
+func isTransientError(err error) bool {
+	var labeled labeledError
+	if errors.As(err, &labeled) {
+		for _, label := range transientLabels {
+			if labeled.HasErrorLabel(label) {
+				return true
+			}
+		}
+	}
+	return isTimeoutError(err)
+}
+
+// isTimeoutError tells whether err is a timeout, e.g. no server selected in
+// time or a connection timing out.
+func isTimeoutError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// the driver keeps only the message of a server selection timeout
+	if strings.Contains(err.Error(), topology.ErrServerSelectionTimeout.Error()) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Mongo reports a duplicate key as e.g. "dup key: { isbn: \"123\" }"
+var dupKeyPattern = regexp.MustCompile(`dup key: \{ ?"?(\w+)"?\s*:`)
+
+// duplicateKeyField tells whether err is a unique index violation, and on
+// which field.
+func duplicateKeyField(err error) (string, bool) {
+	var messages []string
+	var writeErr mongo.WriteException
+	var cmdErr mongo.CommandError
+	switch {
+	case errors.As(err, &writeErr):
+		for _, we := range writeErr.WriteErrors {
+			if isDuplicateKeyCode(we.Code) {
+				messages = append(messages, we.Message)
+			}
+		}
+		if wce := writeErr.WriteConcernError; wce != nil && isDuplicateKeyCode(wce.Code) {
+			messages = append(messages, wce.Message)
+		}
+	case errors.As(err, &cmdErr):
+		if isDuplicateKeyCode(int(cmdErr.Code)) {
+			messages = append(messages, cmdErr.Message)
+		}
+	}
+	if len(messages) == 0 {
+		return "", false
+	}
+	if m := dupKeyPattern.FindStringSubmatch(messages[0]); m != nil {
+		return m[1], true
+	}
+	return "a unique field", true
+}
+
+func isDuplicateKeyCode(code int) bool {
+	return code == 11000 || code == 11001 || code == 12582
+}
@@ -0,0 +1,134 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// duplicateKeyError is the error a write colliding on the unique index of
+// field gets from the server.
+func duplicateKeyError(field string) error {
+	return mongo.WriteException{WriteErrors: []mongo.WriteError{{
+		Code:    11000,
+		Message: fmt.Sprintf(`E11000 duplicate key error collection: tracker.book index: %s_1 dup key: { %s: "9780131103627" }`, field, field),
+	}}}
+}
+
+func TestDuplicateKeyField(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantField string
+		wantOK    bool
+	}{
+		{"duplicate isbn", duplicateKeyError("isbn"), "isbn", true},
+		{"duplicate slug", duplicateKeyError("slug"), "slug", true},
+		{"wrapped", fmt.Errorf("adding book: %w", duplicateKeyError("isbn")), "isbn", true},
+		{"command error", mongo.CommandError{Code: 11000, Message: `E11000 duplicate key error dup key: { isbn: "1" }`}, "isbn", true},
+		{"unknown field", mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error"}}}, "a unique field", true},
+		{"other write error", mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 121, Message: "Document failed validation"}}}, "", false},
+		{"not a mongo error", errors.New("isbn dup key"), "", false},
+		{"nil", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, ok := duplicateKeyField(tt.err)
+			if field != tt.wantField || ok != tt.wantOK {
+				t.Errorf("duplicateKeyField = %q, %v, want %q, %v", field, ok, tt.wantField, tt.wantOK)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error timing out, e.g. a read deadline passing.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network error", mongo.CommandError{Labels: []string{"NetworkError"}, Wrapped: errors.New("connection reset")}, true},
+		{"retryable write error", mongo.WriteException{Labels: []string{"RetryableWriteError"}}, true},
+		{"transient transaction error", mongo.CommandError{Code: 112, Labels: []string{"TransientTransactionError"}}, true},
+		{"wrapped", fmt.Errorf("listing books: %w", mongo.CommandError{Labels: []string{"NetworkError"}}), true},
+		{"server selection timeout", fmt.Errorf("server selection error: %v, current topology: { Type: Unknown }", topology.ErrServerSelectionTimeout), true},
+		{"connection timeout", fmt.Errorf("reading: %w", timeoutError{}), true},
+		{"duplicate key", duplicateKeyError("isbn"), false},
+		{"unlabeled command error", mongo.CommandError{Code: 2, Message: "BadValue"}, false},
+		{"no documents", mongo.ErrNoDocuments, false},
+		{"not a mongo error", errors.New("network down"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTZ(t *testing.T) {
+	tests := []struct {
+		name    string
+		tz      string
+		want    string
+		wantErr bool
+	}{
+		{"not sent", "", "UTC", false},
+		{"utc", "UTC", "UTC", false},
+		{"iana zone", "America/New_York", "America/New_York", false},
+		{"server zone", "Local", "", true},
+		{"unknown zone", "Nowhere/Atlantis", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/?tz="+url.QueryEscape(tt.tz), nil)
+			loc, err := parseTZ(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTZ(%q) error = %v, want error %v", tt.tz, err, tt.wantErr)
+			}
+			if err == nil && loc.String() != tt.want {
+				t.Errorf("parseTZ(%q) = %s, want %s", tt.tz, loc, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseWriteError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCode  int
+		wantError string
+	}{
+		{"duplicate isbn", duplicateKeyError("isbn"), http.StatusConflict, "isbn is already used by another book"},
+		{"other error", errors.New("write failed"), http.StatusBadRequest, "write failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", func(c *gin.Context) { ResponseWriteError(c, tt.err) })
+
+			w, resp := send(t, router, "GET", "/", nil, nil)
+			if w.Code != tt.wantCode || resp.Error != tt.wantError {
+				t.Errorf("got %d %q, want %d %q", w.Code, resp.Error, tt.wantCode, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package tracker
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errInvalidRequest = errors.New("invalid request, see Errors")
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validator collects every problem of a request, so the client can fix them
+// all at once.
+type validator struct {
+	errors []FieldError
+}
+
+// check records err against field, it tells whether err was nil.
+func (v *validator) check(field string, err error) bool {
+	if err == nil {
+		return true
+	}
+	v.errors = append(v.errors, FieldError{Field: field, Message: err.Error()})
+	return false
+}
+
+// require records field as missing when value is empty.
+func (v *validator) require(field, value string) {
+	if value == "" {
+		v.errors = append(v.errors, FieldError{Field: field, Message: field + " is required"})
+	}
+}
+
+func (v *validator) valid() bool {
+	return len(v.errors) == 0
+}
+
+// ResponseInvalid is a 400 listing every problem found by v.
+func ResponseInvalid(c *gin.Context, v *validator) {
+	c.JSON(http.StatusBadRequest, serverResponse{
+		Success: false,
+		Error:   errInvalidRequest.Error(),
+		Errors:  v.errors,
+	})
+}
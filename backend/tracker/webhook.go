@@ -0,0 +1,94 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A finished book is POSTed to TRACKER_FINISH_WEBHOOK_URL, unless
+// TRACKER_FINISH_WEBHOOK_ENABLED is false.
+var finishWebhook = struct {
+	url     string
+	enabled bool
+	timeout time.Duration
+	retries int
+}{
+	url:     envString("TRACKER_FINISH_WEBHOOK_URL", ""),
+	enabled: envBool("TRACKER_FINISH_WEBHOOK_ENABLED", true),
+	timeout: envDuration("TRACKER_FINISH_WEBHOOK_TIMEOUT", 5*time.Second),
+	retries: envInt("TRACKER_FINISH_WEBHOOK_RETRIES", 3),
+}
+
+// finishPayload is the body of the finish webhook.
+type finishPayload struct {
+	ID         string    `json:"id"`
+	Title      string    `json:"title"`
+	Author     string    `json:"author"`
+	Authors    []string  `json:"authors"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// notifyFinished posts book to the finish webhook in the background, retrying
+// failed attempts with a growing delay. Delivery is best effort, a webhook
+// that keeps failing is only logged.
+func notifyFinished(book Book) {
+	if !finishWebhook.enabled || finishWebhook.url == "" {
+		return
+	}
+	payload := finishPayload{
+		ID:         book.ID.Hex(),
+		Title:      book.Title,
+		Author:     book.Author,
+		Authors:    book.Authors,
+		FinishedAt: book.EndTime,
+	}
+	if payload.FinishedAt.IsZero() {
+		payload.FinishedAt = time.Now()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logErrorf("finish webhook: %v", err)
+		return
+	}
+
+	go func() {
+		delay := time.Second
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(finishWebhook.url, body)
+			if err == nil {
+				logDebugf("finish webhook sent for book %s", payload.ID)
+				return
+			}
+			if attempt > finishWebhook.retries {
+				logErrorf("finish webhook for book %s failed after %d attempts: %v", payload.ID, attempt, err)
+				return
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+func postWebhook(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), finishWebhook.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package tracker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordFinishWebhook points the finish webhook to a test server, returning
+// the ids of the books it receives.
+func recordFinishWebhook(t *testing.T) func() []string {
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload finishPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding the webhook payload: %v", err)
+		}
+		mu.Lock()
+		ids = append(ids, payload.ID)
+		mu.Unlock()
+	}))
+	previous := finishWebhook
+	finishWebhook.url, finishWebhook.enabled = server.URL, true
+	t.Cleanup(func() {
+		finishWebhook = previous
+		server.Close()
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		received := append([]string(nil), ids...)
+		sort.Strings(received)
+		return received
+	}
+}
+
+func TestEditBookStatusNotifiesFinished(t *testing.T) {
+	h := newTestService(t)
+	received := recordFinishWebhook(t)
+
+	reading := addTestBook(t, h, url.Values{"title": {"Reading"}, "status": {"reading"}})
+	reading2 := addTestBook(t, h, url.Values{"title": {"Reading"}, "status": {"reading"}})
+	finished := addTestBook(t, h, url.Values{"title": {"Finished"}, "status": {"finished"}})
+	toRead := addTestBook(t, h, url.Values{"title": {"To read"}, "status": {"to_read"}})
+
+	form := url.Values{"status": {"finished"}}
+	for _, book := range []Book{reading, reading2, finished, toRead} {
+		form.Add("ids", book.ID.Hex())
+	}
+	if w, _ := send(t, h, "POST", "/book/batch/status", form, nil); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+
+	want := []string{reading.ID.Hex(), reading2.ID.Hex()}
+	sort.Strings(want)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(received()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// anything sent for the other books would have arrived by now
+	time.Sleep(50 * time.Millisecond)
+	got := received()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("webhook received %q, want %q", got, want)
+	}
+}
@@ -39,8 +39,17 @@ function fetchData(method, url, data) {
 
 export default class API {
 
-    static getBookList() {
-        return fetchData('GET', "/book")
+    // the server answers the list a page at a time, gather every page
+    static async getBookList() {
+        const pageSize = 100
+        let books = []
+        for (let page = 1; ; page++) {
+            const list = await fetchData('GET', `/book?page=${page}&pageSize=${pageSize}`) || []
+            books = books.concat(list)
+            if (list.length < pageSize) {
+                return books
+            }
+        }
     }
     static getBook(id) {
         return fetchData('GET', "/book/" + id)